@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ===== CREDENTIALS =========================================================
+
+// Passwords are never stored: each user gets a random salt and a
+// PBKDF2-HMAC-SHA256 hash of their password.
+
+const (
+	PBKDF2_ITERATIONS = 100000
+	SALT_LENGTH       = 16
+	HASH_LENGTH       = 32
+)
+
+var (
+	ErrAlreadyRegistered = errors.New("User is already registered")
+	ErrNameInUse         = errors.New("User name is already in use, ask an admin for a password")
+	ErrNameReserved      = errors.New("User name is reserved")
+	ErrBadCredentials    = errors.New("Invalid user or password")
+	ErrBadToken          = errors.New("Invalid or expired session token")
+)
+
+type Credential struct {
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+}
+
+type Credentials struct {
+	path       string
+	iterations int
+	users      map[string]*Credential
+	lock       sync.Mutex
+}
+
+// NewCredentials returns an in-memory credential store.
+func NewCredentials(iterations int) *Credentials {
+	return &Credentials{
+		iterations: iterations,
+		users:      make(map[string]*Credential),
+	}
+}
+
+// OpenCredentials loads the credential store at path, which is rewritten
+// whenever a password is set.
+func OpenCredentials(path string) (*Credentials, error) {
+	c := NewCredentials(PBKDF2_ITERATIONS)
+	c.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &c.users)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Credentials) Register(user, secret string) error {
+	return c.set(user, secret, false)
+}
+
+// SetPassword gives user a new password, whether or not they have one.
+func (c *Credentials) SetPassword(user, secret string) error {
+	return c.set(user, secret, true)
+}
+
+// Has reports whether user has a password.
+func (c *Credentials) Has(user string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.users[user] != nil
+}
+
+func (c *Credentials) set(user, secret string, replace bool) error {
+	if user == "" || secret == "" {
+		return errors.New("User name and password required")
+	}
+	salt := make([]byte, SALT_LENGTH)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	hash, err := pbkdf2.Key(sha256.New, secret, salt, c.iterations, HASH_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := c.users[user]
+	if old != nil && !replace {
+		return ErrAlreadyRegistered
+	}
+	c.users[user] = &Credential{
+		Salt:       base64.StdEncoding.EncodeToString(salt),
+		Hash:       base64.StdEncoding.EncodeToString(hash),
+		Iterations: c.iterations,
+	}
+	err = c.save()
+	if err != nil {
+		if old == nil {
+			delete(c.users, user)
+		} else {
+			c.users[user] = old
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *Credentials) Verify(user, secret string) error {
+	c.lock.Lock()
+	credential := c.users[user]
+	c.lock.Unlock()
+	if credential == nil || secret == "" {
+		return ErrBadCredentials
+	}
+	salt, err := base64.StdEncoding.DecodeString(credential.Salt)
+	if err != nil {
+		return err
+	}
+	expected, err := base64.StdEncoding.DecodeString(credential.Hash)
+	if err != nil {
+		return err
+	}
+	hash, err := pbkdf2.Key(sha256.New, secret, salt, credential.Iterations, len(expected))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(hash, expected) != 1 {
+		return ErrBadCredentials
+	}
+	return nil
+}
+
+// save must be called with the lock held
+func (c *Credentials) save() error {
+	if c.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(c.users)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, b)
+}
+
+// ===== SESSION TOKENS ======================================================
+
+// After logging in with a password a client is issued an opaque session
+// token it can log in with instead until the token expires or is revoked.
+// Like passwords, only a hash of each token is kept.
+
+const (
+	TOKEN_LENGTH = 32
+	TOKEN_TTL    = 30 * 24 * time.Hour
+)
+
+type Token struct {
+	User    string    `json:"user"`
+	Expires time.Time `json:"expires"`
+}
+
+type Tokens struct {
+	path   string
+	ttl    time.Duration
+	tokens map[string]*Token // by hash
+	lock   sync.Mutex
+}
+
+// NewTokens returns an in-memory token store.
+func NewTokens(ttl time.Duration) *Tokens {
+	return &Tokens{
+		ttl:    ttl,
+		tokens: make(map[string]*Token),
+	}
+}
+
+// OpenTokens loads the token store at path, which is rewritten whenever a
+// token is issued or revoked.
+func OpenTokens(path string, ttl time.Duration) (*Tokens, error) {
+	t := NewTokens(ttl)
+	t.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &t.tokens)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Issue returns a new token for user and when it expires.
+func (t *Tokens) Issue(user string) (string, time.Time, error) {
+	b := make([]byte, TOKEN_LENGTH)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(t.ttl)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tokens[hashToken(token)] = &Token{User: user, Expires: expires}
+	return token, expires, t.save()
+}
+
+func (t *Tokens) Verify(user, token string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	found := t.tokens[hashToken(token)]
+	if found == nil || found.User != user || time.Now().After(found.Expires) {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// Revoke kills a single token, as on logout.
+func (t *Tokens) Revoke(token string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.tokens, hashToken(token))
+	return t.save()
+}
+
+// RevokeUser kills every token issued to user and returns how many there
+// were.
+func (t *Tokens) RevokeUser(user string) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	revoked := 0
+	for hash, token := range t.tokens {
+		if token.User == user {
+			delete(t.tokens, hash)
+			revoked++
+		}
+	}
+	return revoked, t.save()
+}
+
+// save must be called with the lock held. Expired tokens are dropped.
+func (t *Tokens) save() error {
+	now := time.Now()
+	for hash, token := range t.tokens {
+		if now.After(token.Expires) {
+			delete(t.tokens, hash)
+		}
+	}
+	if t.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(t.tokens)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, b)
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ===== CLIENT CACHE ========================================================
+
+// A client keeps its Data on disk along with the cursor it had reached, so
+// that on startup it only asks the server for what happened since rather
+// than replaying the user's whole history.
+
+const CACHE_INTERVAL = 5 * time.Second
+
+type clientCache struct {
+	Cursor int   `json:"cursor"`
+	Data   *Data `json:"data"`
+}
+
+// LoadClientCache returns the data and cursor cached at path, or fresh data
+// and a zero cursor if there is no cache.
+func LoadClientCache(path string) (*Data, int, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return NewData(), 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	cache := &clientCache{Data: NewData()}
+	err = json.Unmarshal(b, cache)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cache.Data, cache.Cursor, nil
+}
+
+func SaveClientCache(path string, data *Data, cursor int) error {
+	b, err := json.Marshal(&clientCache{Cursor: cursor, Data: data})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/seanpont/gobro"
 	"github.com/seanpont/gobro/commander"
@@ -11,34 +16,95 @@ import (
 	"io"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // ===== MODEL ===============================================================
 
 type Message struct {
-	TapId int
-	User  string
-	Body  string
+	TapId     int
+	Type      string // of the tap that said it; only messages can be edited
+	User      string
+	Body      string
+	Time      time.Time
+	Edited    bool
+	Deleted   bool
+	Parent    int                 // the message this replies to, if any
+	Replies   []int               // tap ids of the replies to this message, in order
+	Reactions map[string][]string // who reacted, by reaction
 }
 
 func (m *Message) String() string {
+	if m.Deleted {
+		return fmt.Sprintf("%s: (message deleted)", m.User)
+	}
+	if m.Edited {
+		return fmt.Sprintf("%s: %s (edited)", m.User, m.Body)
+	}
 	return fmt.Sprintf("%s: %s", m.User, m.Body)
 }
 
 type Conversation struct {
-	TapId    int
-	Title    string
-	Users    map[string]int
-	Messages []*Message
+	Id        string
+	TapId     int
+	LastTapId int // the last tap applied to it
+	Title     string
+	Topic     string
+	Creator   string // may edit and delete anyone's messages
+	Users     map[string]int
+	Messages  []*Message     // in tap order
+	Read      map[string]int // the last tap id each user has seen, by user
 }
 
 func (c *Conversation) String() string {
 	return c.Title
 }
 
+// Copy returns a deep copy of the conversation.
+func (c *Conversation) Copy() *Conversation {
+	copied := *c
+	copied.Users = make(map[string]int, len(c.Users))
+	for user, membershipId := range c.Users {
+		copied.Users[user] = membershipId
+	}
+	copied.Read = make(map[string]int, len(c.Read))
+	for user, tapId := range c.Read {
+		copied.Read[user] = tapId
+	}
+	copied.Messages = make([]*Message, len(c.Messages))
+	for i, message := range c.Messages {
+		m := *message
+		m.Replies = append([]int(nil), message.Replies...)
+		if message.Reactions != nil {
+			m.Reactions = make(map[string][]string, len(message.Reactions))
+			for reaction, users := range message.Reactions {
+				m.Reactions[reaction] = append([]string(nil), users...)
+			}
+		}
+		copied.Messages[i] = &m
+	}
+	return &copied
+}
+
+// conversationId names the conversation created by the tap with the given
+// id. Titles need not be unique, so taps refer to conversations by id.
+func conversationId(tapId int) string {
+	return strconv.Itoa(tapId)
+}
+
+func (c *Conversation) HasUser(user string) bool {
+	_, ok := c.Users[user]
+	return ok
+}
+
 func (c *Conversation) LastMessage() *Message {
 	last := len(c.Messages) - 1
 	if last >= 0 {
@@ -48,18 +114,34 @@ func (c *Conversation) LastMessage() *Message {
 	}
 }
 
+// Unread counts the messages others have said since user last read the
+// conversation.
+func (c *Conversation) Unread(user string) int {
+	read := c.Read[user]
+	unread := 0
+	for i := len(c.Messages) - 1; i >= 0 && c.Messages[i].TapId > read; i-- {
+		if c.Messages[i].User != user && !c.Messages[i].Deleted {
+			unread++
+		}
+	}
+	return unread
+}
+
 func (c *Conversation) NewMessage(tap *Tap) {
 	c.Messages = append(c.Messages, &Message{
-		TapId: tap.Id,
-		User:  tap.User,
-		Body:  tap.Value,
+		TapId:  tap.Id,
+		Type:   tap.Type,
+		User:   tap.User,
+		Body:   tap.Value,
+		Time:   tap.Time,
+		Parent: tap.Parent,
 	})
 }
 
 type Data struct {
 	Taps          []*Tap
 	Users         map[string]int
-	Conversations map[string]*Conversation
+	Conversations map[string]*Conversation // by id
 }
 
 func NewData() *Data {
@@ -70,39 +152,165 @@ func NewData() *Data {
 	}
 }
 
-func (d *Data) Update(tap *Tap) (err error) {
+// Prepare fills in what follows from a tap before it is applied: the id and
+// title of a new conversation, the text of system messages and the thread a
+// reply joins. It leaves d alone and preparing a tap again changes nothing,
+// so a store can write taps down in their final form before applying them.
+func (d *Data) Prepare(tap *Tap) {
 	switch tap.Type {
-	case TYPE_AUTH:
-		err = d.CreateUser(tap)
 	case TYPE_CONVERSATION:
-		err = d.CreateConversation(tap)
+		if tap.Title == "" {
+			tap.Title = tap.Conversation // from a client that predates conversation ids
+		}
+		tap.Conversation = conversationId(tap.Id)
+		if tap.Value == "" {
+			tap.Value = "Created conversation"
+			if len(tap.Args) > 0 {
+				tap.Value += " with " + strings.Join(tap.Args, ", ")
+			}
+		}
 	case TYPE_MESSAGE:
-		err = d.SendMessage(tap)
+		// Threads are one level deep: a reply to a reply joins its thread
+		c := d.Conversations[tap.Conversation]
+		if c != nil && tap.Parent != 0 {
+			parent := c.Message(tap.Parent)
+			if parent != nil && parent.Parent != 0 {
+				tap.Parent = parent.Parent
+			}
+		}
 	case TYPE_INVITE:
-		err = d.Invite(tap)
+		tap.Value = fmt.Sprintf("%s invited %s", tap.User, strings.Join(tap.Args, ", "))
+	case TYPE_LEAVE:
+		tap.Value = fmt.Sprintf("%s left", tap.User)
+	case TYPE_RENAME:
+		if len(tap.Args) > 0 {
+			tap.Value = fmt.Sprintf("%s renamed the conversation to %s",
+				tap.User, strings.TrimSpace(tap.Args[0]))
+		}
+	case TYPE_TOPIC:
+		topic := ""
+		if len(tap.Args) > 0 {
+			topic = strings.TrimSpace(tap.Args[0])
+		}
+		if topic == "" {
+			tap.Value = fmt.Sprintf("%s cleared the topic", tap.User)
+		} else {
+			tap.Value = fmt.Sprintf("%s set the topic to %s", tap.User, topic)
+		}
 	}
-	return
 }
 
-func (d *Data) CreateUser(tap *Tap) error {
-	if tap.User == "" {
-		return errors.New("User name required")
+// Update checks a tap and applies it if it is valid.
+func (d *Data) Update(tap *Tap) error {
+	err := d.Check(tap)
+	if err != nil {
+		return err
+	}
+	d.Apply(tap)
+	return nil
+}
+
+// Check prepares a tap and returns why it can't be applied, if it can't. It
+// leaves d alone, so a store can check a tap, write it down and only then
+// apply it.
+func (d *Data) Check(tap *Tap) error {
+	d.Prepare(tap)
+	// A conversation replayed to a client that already has it must not
+	// say its messages twice or toggle its reactions back
+	c := d.Conversations[tap.Conversation]
+	if c != nil && tap.Type != TYPE_CONVERSATION && tap.Id <= c.LastTapId {
+		return fmt.Errorf("Tap %d was already applied", tap.Id)
+	}
+	switch tap.Type {
+	case TYPE_AUTH:
+		if tap.User == "" {
+			return errors.New("User name required")
+		}
+	case TYPE_CONVERSATION:
+		if tap.Title == "" {
+			return errors.New("Conversation title required")
+		}
+		if c != nil {
+			return errors.New("Conversation '" + tap.Conversation + "' already exists")
+		}
+	case TYPE_MESSAGE:
+		return d.checkMessage(tap)
+	case TYPE_INVITE:
+		return d.checkInvite(tap)
+	case TYPE_LEAVE, TYPE_TOPIC:
+		_, err := d.member(tap)
+		return err
+	case TYPE_RENAME:
+		_, err := d.member(tap)
+		if err != nil {
+			return err
+		}
+		if len(tap.Args) == 0 || strings.TrimSpace(tap.Args[0]) == "" {
+			return errors.New("New title required")
+		}
+	case TYPE_EDIT:
+		if tap.Value == "" {
+			return errors.New("Value (new message body) required")
+		}
+		return d.checkTarget(tap)
+	case TYPE_DELETE:
+		return d.checkTarget(tap)
+	case TYPE_REACT:
+		if tap.Value == "" || strings.ContainsAny(tap.Value, " \t\n") {
+			return errors.New("Value (reaction, without spaces) required")
+		}
+		_, _, err := d.message(tap)
+		return err
+	case TYPE_READ:
+		return d.checkRead(tap)
+	default:
+		return errors.New("Unknown tap type '" + tap.Type + "'")
 	}
-	d.Users[tap.User] = tap.Id
 	return nil
 }
 
-func (d *Data) CreateConversation(tap *Tap) error {
-	title := tap.Conversation
-	if title == "" {
-		return errors.New("Conversation title required")
+// Apply applies a tap that has passed Check.
+func (d *Data) Apply(tap *Tap) {
+	switch tap.Type {
+	case TYPE_AUTH:
+		d.CreateUser(tap)
+	case TYPE_CONVERSATION:
+		d.CreateConversation(tap)
+	case TYPE_MESSAGE:
+		d.SendMessage(tap)
+	case TYPE_INVITE:
+		d.Invite(tap)
+	case TYPE_LEAVE:
+		d.Leave(tap)
+	case TYPE_RENAME:
+		d.Rename(tap)
+	case TYPE_TOPIC:
+		d.SetTopic(tap)
+	case TYPE_EDIT:
+		d.EditMessage(tap)
+	case TYPE_DELETE:
+		d.DeleteMessage(tap)
+	case TYPE_REACT:
+		d.React(tap)
+	case TYPE_READ:
+		d.MarkRead(tap)
 	}
-	if d.Conversations[title] != nil {
-		return errors.New("Conversation '" + title + "' already exists")
+	c := d.Conversations[tap.Conversation]
+	if c != nil {
+		c.LastTapId = tap.Id
 	}
+}
+
+func (d *Data) CreateUser(tap *Tap) {
+	d.Users[tap.User] = tap.Id
+}
+
+func (d *Data) CreateConversation(tap *Tap) {
 	c := &Conversation{
+		Id:       tap.Conversation,
 		TapId:    tap.Id,
-		Title:    title,
+		Title:    tap.Title,
+		Creator:  tap.User,
 		Users:    make(map[string]int, 0),
 		Messages: make([]*Message, 0),
 	}
@@ -111,56 +319,226 @@ func (d *Data) CreateConversation(tap *Tap) error {
 		d.Users[user] = tap.Id
 		c.Users[user] = tap.Id
 	}
-	if tap.Value == "" {
-		firstMessage := "Created conversation"
-		if len(tap.Args) > 0 {
-			firstMessage += " with " + strings.Join(tap.Args, ", ")
-		}
-		tap.Value = firstMessage
-	}
 	c.NewMessage(tap)
-	d.Conversations[c.Title] = c
-	return nil
+	d.Conversations[c.Id] = c
 }
 
-func (d *Data) SendMessage(tap *Tap) error {
+func (d *Data) checkMessage(tap *Tap) error {
 	if tap.Conversation == "" || tap.Value == "" {
 		return errors.New("Conversation and Value (message body) required")
 	}
+	c, err := d.member(tap)
+	if err != nil {
+		return err
+	}
+	if tap.Parent != 0 {
+		parent := c.Message(tap.Parent)
+		if parent == nil || parent.Type != TYPE_MESSAGE {
+			return fmt.Errorf("Message %d not found", tap.Parent)
+		}
+	}
+	return nil
+}
+
+func (d *Data) SendMessage(tap *Tap) {
 	c := d.Conversations[tap.Conversation]
-	if c == nil {
-		return errors.New("Conversation '" + tap.Conversation + "' not found")
+	if tap.Parent != 0 {
+		parent := c.Message(tap.Parent)
+		parent.Replies = append(parent.Replies, tap.Id)
 	}
 	c.NewMessage(tap)
-	return nil
 }
 
-func (d *Data) Invite(tap *Tap) error {
+func (d *Data) checkInvite(tap *Tap) error {
 	if tap.Conversation == "" || len(tap.Args) == 0 {
 		return errors.New("Conversation and args (new participants) required")
 	}
-	c := d.Conversations[tap.Conversation]
-	if c == nil {
-		return errors.New("Conversation '" + tap.Conversation + "' not found")
+	c, err := d.member(tap)
+	if err != nil {
+		return err
 	}
+	for _, user := range tap.Args {
+		if c.HasUser(user) {
+			return errors.New(user + " is already in conversation '" + c.Id + "'")
+		}
+	}
+	return nil
+}
+
+func (d *Data) Invite(tap *Tap) {
+	c := d.Conversations[tap.Conversation]
 	for _, user := range tap.Args {
 		d.Users[user] = tap.Id
 		c.Users[user] = tap.Id
 	}
-	tap.Value = fmt.Sprintf("%s invited %s", tap.User, strings.Join(tap.Args, ", "))
 	c.NewMessage(tap)
+}
+
+func (d *Data) Leave(tap *Tap) {
+	c := d.Conversations[tap.Conversation]
+	delete(c.Users, tap.User)
+	c.NewMessage(tap)
+}
+
+// member returns the conversation a tap is about, provided its sender is in
+// it. Ids are easy to guess, so the error doesn't give the title away.
+func (d *Data) member(tap *Tap) (*Conversation, error) {
+	if tap.Conversation == "" {
+		return nil, errors.New("Conversation required")
+	}
+	c := d.Conversations[tap.Conversation]
+	if c == nil {
+		return nil, errors.New("Conversation '" + tap.Conversation + "' not found")
+	}
+	if !c.HasUser(tap.User) {
+		return nil, errors.New(tap.User + " is not in conversation '" + c.Id + "'")
+	}
+	return c, nil
+}
+
+func (d *Data) Rename(tap *Tap) {
+	c := d.Conversations[tap.Conversation]
+	c.Title = strings.TrimSpace(tap.Args[0])
+	c.NewMessage(tap)
+}
+
+// SetTopic sets the conversation's topic to the tap's first arg, or clears
+// it if there is none.
+func (d *Data) SetTopic(tap *Tap) {
+	c := d.Conversations[tap.Conversation]
+	c.Topic = ""
+	if len(tap.Args) > 0 {
+		c.Topic = strings.TrimSpace(tap.Args[0])
+	}
+	c.NewMessage(tap)
+}
+
+// Message returns the message said by the tap with the given id, or nil.
+func (c *Conversation) Message(tapId int) *Message {
+	i := sort.Search(len(c.Messages), func(i int) bool {
+		return c.Messages[i].TapId >= tapId
+	})
+	if i < len(c.Messages) && c.Messages[i].TapId == tapId {
+		return c.Messages[i]
+	}
+	return nil
+}
+
+// message returns the message a tap refers to by the tap id in its first
+// arg, provided its sender is in the conversation and it is still there.
+func (d *Data) message(tap *Tap) (*Conversation, *Message, error) {
+	c, err := d.member(tap)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tap.Args) == 0 {
+		return nil, nil, errors.New("Args (message id) required")
+	}
+	tapId, err := strconv.Atoi(tap.Args[0])
+	if err != nil {
+		return nil, nil, errors.New("Bad message id '" + tap.Args[0] + "'")
+	}
+	m := c.Message(tapId)
+	if m == nil || m.Type != TYPE_MESSAGE {
+		return nil, nil, errors.New("Message " + tap.Args[0] + " not found")
+	}
+	if m.Deleted {
+		return nil, nil, errors.New("Message " + tap.Args[0] + " was deleted")
+	}
+	return c, m, nil
+}
+
+// checkTarget checks that the sender of an edit or delete tap may change the
+// message it refers to.
+func (d *Data) checkTarget(tap *Tap) error {
+	c, m, err := d.message(tap)
+	if err != nil {
+		return err
+	}
+	if tap.User != m.User && tap.User != c.Creator {
+		return errors.New("Only its author or the conversation's creator may change a message")
+	}
 	return nil
 }
 
+func (d *Data) EditMessage(tap *Tap) {
+	_, m, _ := d.message(tap)
+	m.Body = tap.Value
+	m.Edited = true
+}
+
+func (d *Data) DeleteMessage(tap *Tap) {
+	_, m, _ := d.message(tap)
+	m.Body = ""
+	m.Deleted = true
+}
+
+// React adds the tap's sender to those who reacted to a message with the
+// tap's value, or takes them off if they already had.
+func (d *Data) React(tap *Tap) {
+	reaction := tap.Value
+	_, m, _ := d.message(tap)
+	if m.Reactions == nil {
+		m.Reactions = make(map[string][]string)
+	}
+	users := m.Reactions[reaction]
+	for i, user := range users {
+		if user == tap.User {
+			users = append(users[:i:i], users[i+1:]...)
+			if len(users) == 0 {
+				delete(m.Reactions, reaction)
+			} else {
+				m.Reactions[reaction] = users
+			}
+			return
+		}
+	}
+	m.Reactions[reaction] = append(users, tap.User)
+}
+
+func (d *Data) checkRead(tap *Tap) error {
+	_, err := d.member(tap)
+	if err != nil {
+		return err
+	}
+	if len(tap.Args) == 0 {
+		return errors.New("Args (last tap id seen) required")
+	}
+	tapId, err := strconv.Atoi(tap.Args[0])
+	if err != nil || tapId < 0 || tapId >= tap.Id {
+		return errors.New("Bad tap id '" + tap.Args[0] + "'")
+	}
+	return nil
+}
+
+// MarkRead records that the tap's sender has seen the conversation up to the
+// tap id in its first arg. Markers only ever move forward.
+func (d *Data) MarkRead(tap *Tap) {
+	c := d.Conversations[tap.Conversation]
+	tapId, _ := strconv.Atoi(tap.Args[0])
+	if c.Read == nil {
+		c.Read = make(map[string]int)
+	}
+	if tapId > c.Read[tap.User] {
+		c.Read[tap.User] = tapId
+	}
+}
+
 // ===== TAP PROTOCOL ========================================================
 
 type Tap struct {
-	Id           int      `json:"id"`
-	Type         string   `json:"type"`
-	User         string   `json:"user"`
-	Conversation string   `json:"conversation"`
-	Value        string   `json:"value"`
-	Args         []string `json:"args"`
+	Id           int       `json:"id"`
+	Type         string    `json:"type"`
+	User         string    `json:"user"`
+	Conversation string    `json:"conversation"`
+	Title        string    `json:"title,omitempty"` // only on conversation taps
+	Value        string    `json:"value"`
+	Args         []string  `json:"args"`
+	Secret       string    `json:"secret,omitempty"`  // password; only sent on auth and register
+	Token        string    `json:"token,omitempty"`   // session token; may replace Secret on auth
+	Request      string    `json:"request,omitempty"` // client-chosen id, echoed in the ack or error
+	Parent       int       `json:"parent,omitempty"`  // on replies: the tap id of the message replied to
+	Time         time.Time `json:"time,omitzero"`     // when the server accepted it; unset on pings, acks and errors
 }
 
 func NewTap(_type, user, conversation, value string, args ...string) *Tap {
@@ -174,33 +552,78 @@ func NewTap(_type, user, conversation, value string, args ...string) *Tap {
 	return &tap
 }
 
+// NewConversationTap asks for a new conversation. The server assigns its id.
+func NewConversationTap(user, title string, users ...string) *Tap {
+	return &Tap{
+		Type:  TYPE_CONVERSATION,
+		User:  user,
+		Title: title,
+		Args:  users,
+	}
+}
+
 const (
 	// Types
 	TYPE_ERROR        = "error"
+	TYPE_ACK          = "ack"
 	TYPE_AUTH         = "auth"
+	TYPE_REGISTER     = "register"
+	TYPE_TOKEN        = "token"
+	TYPE_LOGOUT       = "logout"
+	TYPE_REVOKE       = "revoke"
+	TYPE_PASSWORD     = "password"
 	TYPE_CONVERSATION = "conversation"
 	TYPE_MESSAGE      = "message"
 	TYPE_INVITE       = "invite"
+	TYPE_LEAVE        = "leave"
+	TYPE_RENAME       = "rename"
+	TYPE_TOPIC        = "topic"
+	TYPE_EDIT         = "edit"
+	TYPE_DELETE       = "delete"
+	TYPE_REACT        = "react"
+	TYPE_READ         = "read"
+	TYPE_PING         = "ping"
+	TYPE_PONG         = "pong"
+	TYPE_SHUTDOWN     = "shutdown"
 )
 
 // ===== NETWORKING ==========================================================
 
-func connToChan(conn net.Conn) (<-chan *Tap, chan<- *Tap) {
+// connToChan reads and writes taps on conn through channels. Closing the
+// outbox closes conn once everything sent on it has been written. If writers
+// is given, the goroutine writing to conn is added to it, so that the caller
+// can wait for that.
+func connToChan(conn net.Conn, writers *sync.WaitGroup) (<-chan *Tap, chan<- *Tap) {
 	inbox := make(chan *Tap)
 	outbox := make(chan *Tap)
+	closed := make(chan bool)
 
 	// Outbox
+	if writers != nil {
+		writers.Add(1)
+	}
 	go func() {
+		if writers != nil {
+			defer writers.Done()
+		}
+		defer close(closed)
 		defer conn.Close()
 		encoder := json.NewEncoder(conn)
+		broken := false
 		for {
 			tap, ok := <-outbox
 			if !ok {
 				return
 			}
+			if broken {
+				continue // discard until the other side notices
+			}
+			conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
 			err := encoder.Encode(tap)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "Error encoding tap:", tap, err)
+				conn.Close() // the inbox sees this and the session ends
+				broken = true
 			}
 		}
 	}()
@@ -218,87 +641,579 @@ func connToChan(conn net.Conn) (<-chan *Tap, chan<- *Tap) {
 				close(inbox)
 				return
 			}
-			inbox <- tap
+			select {
+			case inbox <- tap:
+			case <-closed:
+				close(inbox) // nobody is listening any more
+				return
+			}
 		}
 	}()
 
 	return inbox, outbox
 }
 
+const (
+	WRITE_TIMEOUT      = 10 * time.Second
+	HEARTBEAT_INTERVAL = 30 * time.Second
+	IDLE_TIMEOUT       = 90 * time.Second
+)
+
+// A heartbeat pings the other end of a connection every interval and
+// notices when nothing at all has been heard from it for timeout. Both ends
+// answer pings with pongs, so a live connection is never idle for long. The
+// two are independent: turning pings off doesn't turn off the timeout.
+type heartbeat struct {
+	C         <-chan time.Time // time to ping; nil if heartbeats are off
+	Idle      <-chan time.Time // time to check isDead; nil if the timeout is off
+	timeout   time.Duration
+	ticker    *time.Ticker
+	timer     *time.Timer
+	lastHeard time.Time
+}
+
+func newHeartbeat(interval, timeout time.Duration) *heartbeat {
+	h := &heartbeat{timeout: timeout, lastHeard: time.Now()}
+	if interval > 0 {
+		h.ticker = time.NewTicker(interval)
+		h.C = h.ticker.C
+	}
+	if timeout > 0 {
+		h.timer = time.NewTimer(timeout)
+		h.Idle = h.timer.C
+	}
+	return h
+}
+
+func (h *heartbeat) heard() {
+	h.lastHeard = time.Now()
+}
+
+// isDead must be called each time Idle fires. If something has been heard
+// since the timer was set, it sets it again for the rest of the timeout.
+func (h *heartbeat) isDead() bool {
+	idle := time.Since(h.lastHeard)
+	if idle >= h.timeout {
+		return true
+	}
+	h.timer.Reset(h.timeout - idle)
+	return false
+}
+
+func (h *heartbeat) stop() {
+	if h.ticker != nil {
+		h.ticker.Stop()
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
 // ===== SERVER ==============================================================
 
 type ConnTapServer struct {
-	data        *Data
-	tapChans    map[string]chan bool
-	tapChanLock sync.Mutex
-	tapCore     chan *Tap
+	store         TapStore
+	config        ServerConfig
+	credentials   *Credentials
+	tokens        *Tokens
+	sessions      map[string]map[*session]bool // by user
+	listener      net.Listener
+	closing       bool
+	sessionLock   sync.Mutex     // guards sessions, listener and closing
+	handlers      sync.WaitGroup // connections, sessions and their writers
+	tapCore       chan *submission
+	quit          chan bool  // closed when shutdown begins
+	stop          chan bool  // closed to stop processTaps
+	stopped       chan error // processTaps is done and storage flushed
+	slowConsumers int64      // sessions ended for falling behind; atomic
+}
+
+// A submission is a tap on its way from a session to processTaps.
+type submission struct {
+	tap  *Tap
+	sess *session
+}
+
+// A session is one client connection. A user may have several.
+type session struct {
+	user    string
+	tapChan chan bool // notified when there may be new taps for user
+	replies chan *Tap // taps meant for this session alone
+	queue   chan *Tap // taps on their way to the client
+	kill    chan bool // closed to end the session
+	once    sync.Once
+}
+
+func newSession(user string, queueSize int) *session {
+	return &session{
+		user:    user,
+		tapChan: make(chan bool, 1),
+		replies: make(chan *Tap, 16),
+		queue:   make(chan *Tap, queueSize),
+		kill:    make(chan bool),
+	}
+}
+
+// forward writes queued taps to the connection until the queue is closed.
+func (sess *session) forward(outbox chan<- *Tap) {
+	defer close(outbox)
+	for tap := range sess.queue {
+		outbox <- tap
+	}
+}
+
+// reply queues a tap for this session alone. It never blocks: a session too
+// far behind to take it simply misses it.
+func (sess *session) reply(tap *Tap) {
+	select {
+	case sess.replies <- tap:
+	default:
+		fmt.Fprintf(os.Stderr, "Dropping %s reply to %s\n", tap.Type, sess.user)
+	}
+}
+
+func (sess *session) end() {
+	sess.once.Do(func() { close(sess.kill) })
+}
+
+// What to do with a client that is not reading its taps fast enough
+type SlowConsumerPolicy int
+
+const (
+	SLOW_DISCONNECT SlowConsumerPolicy = iota // tell the client why, then disconnect
+	SLOW_DROP                                 // disconnect without a word
+)
+
+func ParseSlowConsumerPolicy(policy string) (SlowConsumerPolicy, error) {
+	switch policy {
+	case "disconnect":
+		return SLOW_DISCONNECT, nil
+	case "drop":
+		return SLOW_DROP, nil
+	}
+	return SLOW_DISCONNECT, errors.New("Unknown slow consumer policy '" + policy + "'")
+}
+
+const (
+	SEND_QUEUE       = 256
+	SEND_TIMEOUT     = 10 * time.Second
+	SHUTDOWN_TIMEOUT = 30 * time.Second
+)
+
+var ErrTooSlow = errors.New("Too far behind, disconnecting")
+
+// ErrBadCursor turns away a client that claims to have seen taps the server
+// doesn't have, say because the server's data was lost. The client's data
+// can't be trusted either, so it starts over.
+var ErrBadCursor = errors.New("Cursor is ahead of the server, start over")
+
+type ServerConfig struct {
+	SnapshotInterval time.Duration // 0 disables snapshots
+	Credentials      *Credentials  // nil keeps credentials in memory
+	Tokens           *Tokens       // nil keeps session tokens in memory
+	Admins           []string      // users allowed to revoke tokens and set passwords; they can't register
+	TLS              *tls.Config   // nil serves plain TCP
+	SingleSession    bool          // a new login ends the user's other sessions
+	Heartbeat        time.Duration // how often to ping clients; 0 disables
+	IdleTimeout      time.Duration // end sessions silent for this long; 0 disables
+	SendQueue        int           // taps queued per session; 0 for SEND_QUEUE
+	SendTimeout      time.Duration // how long a full queue may stay full; 0 for SEND_TIMEOUT
+	SlowConsumer     SlowConsumerPolicy
 }
 
 func connTapServer(args []string) {
-	commander.CheckArgs(args, 1, "Usage: tcptap streamTapServer <port>")
-	NewConnTapServer().listen(args[0])
+	usage := "Usage: tcptap connTapServer [-data <dir>] [-sync always|interval|never] [-cert <file> -key <file> [-client-ca <file>]] <port>"
+	flags := flag.NewFlagSet("connTapServer", flag.ExitOnError)
+	dataDir := flags.String("data", "", "directory for the tap log (in-memory if empty)")
+	syncPolicy := flags.String("sync", "always", "when to fsync the tap log: always, interval or never")
+	syncInterval := flags.Duration("sync-interval", time.Second, "fsync interval for -sync interval")
+	snapshotInterval := flags.Duration("snapshot-interval", 10*time.Minute, "how often to snapshot data and compact the tap log (0 to disable)")
+	tokenTTL := flags.Duration("token-ttl", TOKEN_TTL, "how long session tokens are valid for")
+	admins := flags.String("admins", "", "comma-separated users allowed to revoke session tokens and set passwords")
+	certFile := flags.String("cert", "", "TLS certificate file (plain TCP if empty)")
+	keyFile := flags.String("key", "", "TLS private key file")
+	clientCAFile := flags.String("client-ca", "", "CA file for verifying client certificates (enables mutual TLS)")
+	singleSession := flags.Bool("single-session", false, "end a user's other sessions when they log in")
+	heartbeat := flags.Duration("heartbeat", HEARTBEAT_INTERVAL, "how often to ping clients (0 to disable)")
+	idleTimeout := flags.Duration("idle-timeout", IDLE_TIMEOUT, "how long a client may be silent before its session ends (0 to disable)")
+	sendQueue := flags.Int("send-queue", SEND_QUEUE, "how many taps may wait to be sent to each client")
+	sendTimeout := flags.Duration("send-timeout", SEND_TIMEOUT, "how long a client's send queue may stay full before it is disconnected")
+	slowConsumer := flags.String("slow-consumer", "disconnect", "what to do with clients that fall behind: disconnect (with an error) or drop")
+	statsInterval := flags.Duration("stats-interval", time.Minute, "how often to log session stats (0 to disable)")
+	shutdownTimeout := flags.Duration("shutdown-timeout", SHUTDOWN_TIMEOUT, "how long to wait for sessions to end on SIGINT or SIGTERM")
+	flags.Parse(args)
+	commander.CheckArgs(flags.Args(), 1, usage)
+
+	var store TapStore = NewMemStore()
+	var credentials *Credentials
+	tokens := NewTokens(*tokenTTL)
+	if *dataDir != "" {
+		policy, err := ParseSyncPolicy(*syncPolicy)
+		gobro.CheckErr(err)
+		store, err = OpenFileStore(*dataDir, policy, *syncInterval)
+		gobro.CheckErr(err)
+		credentials, err = OpenCredentials(filepath.Join(*dataDir, "credentials.json"))
+		gobro.CheckErr(err)
+		tokens, err = OpenTokens(filepath.Join(*dataDir, "tokens.json"), *tokenTTL)
+		gobro.CheckErr(err)
+	}
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		var err error
+		tlsConfig, err = ServerTLSConfig(*certFile, *keyFile, *clientCAFile)
+		gobro.CheckErr(err)
+	}
+	slowPolicy, err := ParseSlowConsumerPolicy(*slowConsumer)
+	gobro.CheckErr(err)
+	var adminList []string
+	if *admins != "" {
+		adminList = strings.Split(*admins, ",")
+		strarr.TrimAll(adminList)
+	}
+	server := NewConnTapServer(store, ServerConfig{
+		SnapshotInterval: *snapshotInterval,
+		Credentials:      credentials,
+		Tokens:           tokens,
+		Admins:           adminList,
+		TLS:              tlsConfig,
+		SingleSession:    *singleSession,
+		Heartbeat:        *heartbeat,
+		IdleTimeout:      *idleTimeout,
+		SendQueue:        *sendQueue,
+		SendTimeout:      *sendTimeout,
+		SlowConsumer:     slowPolicy,
+	})
+	if *statsInterval > 0 {
+		go server.logStats(*statsInterval)
+	}
+	go server.listen(flags.Arg(0))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	fmt.Println("Received", <-signals, "- shutting down")
+	signal.Stop(signals) // a second signal kills us outright
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	gobro.CheckErr(err)
+	fmt.Println("Shut down cleanly")
+}
+
+// setPassword gives a user a password in a server's data directory while the
+// server is stopped. It is how admins get theirs: their names can't be
+// registered, or anyone could claim them.
+func setPassword(args []string) {
+	usage := "Usage: tcptap setPassword -data <dir> <user>"
+	flags := flag.NewFlagSet("setPassword", flag.ExitOnError)
+	dataDir := flags.String("data", "", "the server's data directory")
+	flags.Parse(args)
+	commander.CheckArgs(flags.Args(), 1, usage)
+	if *dataDir == "" {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	err := os.MkdirAll(*dataDir, 0755)
+	gobro.CheckErr(err)
+	credentials, err := OpenCredentials(filepath.Join(*dataDir, "credentials.json"))
+	gobro.CheckErr(err)
+	password, err := commander.Prompt("Password: ")
+	gobro.CheckErr(err)
+	err = credentials.SetPassword(flags.Arg(0), password)
+	gobro.CheckErr(err)
+	fmt.Println("Set the password of", flags.Arg(0))
 }
 
-func NewConnTapServer() *ConnTapServer {
+func NewConnTapServer(store TapStore, config ServerConfig) *ConnTapServer {
 	s := &ConnTapServer{
-		data:     NewData(),
-		tapChans: make(map[string]chan bool),
-		tapCore:  make(chan *Tap, 100),
+		store:       store,
+		config:      config,
+		credentials: config.Credentials,
+		tokens:      config.Tokens,
+		sessions:    make(map[string]map[*session]bool),
+		tapCore:     make(chan *submission, 100),
+		quit:        make(chan bool),
+		stop:        make(chan bool),
+		stopped:     make(chan error, 1),
+	}
+	if s.credentials == nil {
+		s.credentials = NewCredentials(PBKDF2_ITERATIONS)
+	}
+	if s.tokens == nil {
+		s.tokens = NewTokens(TOKEN_TTL)
+	}
+	if s.config.SendQueue <= 0 {
+		s.config.SendQueue = SEND_QUEUE
+	}
+	if s.config.SendTimeout <= 0 {
+		s.config.SendTimeout = SEND_TIMEOUT
 	}
 	go s.processTaps()
 	return s
 }
 
 func (s *ConnTapServer) processTaps() {
+	var snapshots <-chan time.Time
+	var snapshotDone chan error // while one is being written
+	snapshotter, ok := s.store.(Snapshotter)
+	if ok && s.config.SnapshotInterval > 0 {
+		ticker := time.NewTicker(s.config.SnapshotInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
 	for {
-		tap := <-s.tapCore
-		tap.Id = len(s.data.Taps)
-		fmt.Println("Processing: ", tap)
-		err := s.data.Update(tap)
+		select {
+		case sub := <-s.tapCore:
+			s.processTap(sub.tap, sub.sess)
+		case <-snapshots:
+			// Writing one takes a while; taps keep flowing meanwhile
+			if snapshotDone == nil {
+				snapshotDone = make(chan error, 1)
+				go func(done chan error) {
+					done <- snapshotter.Snapshot()
+				}(snapshotDone)
+			}
+		case err := <-snapshotDone:
+			snapshotDone = nil
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error writing snapshot:", err)
+			}
+		case <-s.stop:
+			s.stopped <- s.drain(snapshots != nil)
+			return
+		}
+	}
+}
+
+// drain processes whatever taps are still waiting and flushes the store.
+func (s *ConnTapServer) drain(snapshot bool) error {
+waiting:
+	for {
+		select {
+		case sub := <-s.tapCore:
+			s.processTap(sub.tap, sub.sess)
+		default:
+			break waiting
+		}
+	}
+	if snapshot {
+		err := s.store.(Snapshotter).Snapshot()
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			continue
+			fmt.Fprintln(os.Stderr, "Error writing snapshot:", err)
+		}
+	}
+	return s.store.Close()
+}
+
+func (s *ConnTapServer) processTap(tap *Tap, sess *session) {
+	fmt.Println("Processing: ", tap)
+	if tap.Request != "" {
+		// A retry of something we already have: just ack it again
+		tapId, ok := s.store.Request(tap.User, tap.Request)
+		if ok {
+			sess.reply(newAck(tap, tapId))
+			return
 		}
-		s.data.Taps = append(s.data.Taps, tap)
+	}
+	tap.Time = time.Now()
+	err := s.store.Append(tap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		// Let the sender know their tap was dropped
+		sess.reply(&Tap{
+			Type:         TYPE_ERROR,
+			User:         tap.User,
+			Conversation: tap.Conversation,
+			Value:        err.Error(),
+			Args:         []string{tap.Type},
+			Request:      tap.Request,
+		})
+		return
+	}
+	if tap.Request != "" {
+		sess.reply(newAck(tap, tap.Id))
+	}
 
-		for user, tapChan := range s.tapChans {
-			if s.isRelevant(user, tap) {
-				fmt.Printf("Sending %s to %s\n", tap.Type, user)
-				notify(tapChan)
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	for user, sessions := range s.sessions {
+		if s.isRelevant(user, tap) {
+			fmt.Printf("Sending %s to %s\n", tap.Type, user)
+			for other, _ := range sessions {
+				notify(other.tapChan)
 			}
 		}
 	}
 }
 
+func newAck(tap *Tap, tapId int) *Tap {
+	return &Tap{
+		Type:    TYPE_ACK,
+		User:    tap.User,
+		Value:   strconv.Itoa(tapId),
+		Request: tap.Request,
+	}
+}
+
+// ServerStats shows how well clients are keeping up with their taps.
+type ServerStats struct {
+	Sessions      int
+	Queued        int   // taps waiting in all send queues
+	MaxQueued     int   // taps waiting in the fullest send queue
+	SlowConsumers int64 // sessions ended for falling behind, ever
+}
+
+func (stats ServerStats) String() string {
+	return fmt.Sprintf("%d sessions, %d taps queued (at most %d), %d slow consumers",
+		stats.Sessions, stats.Queued, stats.MaxQueued, stats.SlowConsumers)
+}
+
+func (s *ConnTapServer) Stats() ServerStats {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	stats := ServerStats{SlowConsumers: atomic.LoadInt64(&s.slowConsumers)}
+	for _, sessions := range s.sessions {
+		for sess, _ := range sessions {
+			queued := len(sess.queue)
+			stats.Sessions++
+			stats.Queued += queued
+			stats.MaxQueued = gobro.Max(stats.MaxQueued, queued)
+		}
+	}
+	return stats
+}
+
+func (s *ConnTapServer) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		fmt.Println("Stats:", s.Stats())
+	}
+}
+
 func (s *ConnTapServer) listen(port string) {
-	listener, err := net.Listen("tcp", ":"+port)
+	var listener net.Listener
+	var err error
+	if s.config.TLS != nil {
+		listener, err = tls.Listen("tcp", ":"+port, s.config.TLS)
+	} else {
+		listener, err = net.Listen("tcp", ":"+port)
+	}
 	gobro.CheckErr(err)
 	fmt.Println("ConnTapServer listening on port", port)
+	s.serve(listener)
+}
+
+// serve accepts connections on listener until the server shuts down.
+func (s *ConnTapServer) serve(listener net.Listener) {
+	s.sessionLock.Lock()
+	if s.closing {
+		s.sessionLock.Unlock()
+		listener.Close()
+		return
+	}
+	s.listener = listener
+	s.sessionLock.Unlock()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
 			gobro.LogErr(err)
 			continue
 		}
-		inbox, outbox := connToChan(conn)
-		go s.handle(inbox, outbox)
+		// Shutdown may already be waiting on handlers, so only add one
+		// while it can't have started
+		s.sessionLock.Lock()
+		if s.closing {
+			s.sessionLock.Unlock()
+			conn.Close()
+			return
+		}
+		s.handlers.Add(1)
+		s.sessionLock.Unlock()
+		go func() {
+			defer s.handlers.Done()
+			s.handleConn(conn)
+		}()
 	}
 }
 
-func (s *ConnTapServer) handle(inbox <-chan *Tap, outbox chan<- *Tap) {
-	defer close(outbox)
+// Shutdown stops accepting connections, tells every connected client that
+// the server is going away and ends their sessions, then processes the taps
+// still in flight and flushes the store. If ctx expires before every session
+// has ended the store is flushed anyway and ctx's error is returned.
+func (s *ConnTapServer) Shutdown(ctx context.Context) error {
+	s.sessionLock.Lock()
+	if s.closing {
+		s.sessionLock.Unlock()
+		return errors.New("Server is already shutting down")
+	}
+	s.closing = true
+	close(s.quit)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for _, sessions := range s.sessions {
+		for sess, _ := range sessions {
+			sess.reply(newShutdownTap(sess.user))
+			sess.end()
+		}
+	}
+	s.sessionLock.Unlock()
 
-	// The first tap must be an auth tap
-	authTap, ok := <-inbox
+	done := make(chan bool)
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	var waitErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
 
-	if !ok {
+	close(s.stop)
+	select {
+	case err := <-s.stopped:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return waitErr
+}
+
+func newShutdownTap(user string) *Tap {
+	return &Tap{
+		Type:  TYPE_SHUTDOWN,
+		User:  user,
+		Value: "Server is shutting down",
+	}
+}
+
+func (s *ConnTapServer) handleConn(conn net.Conn) {
+	certUser, err := peerName(conn)
+	if err != nil {
+		gobro.LogErr(err)
+		conn.Close()
 		return
 	}
-	if authTap.Type != TYPE_AUTH || authTap.User == "" {
-		outbox <- &Tap{
-			Type:  TYPE_ERROR,
-			Value: "First tap must be auth with valid user",
-		}
+	// Shutdown waits for what is queued for the client to go out
+	inbox, outbox := connToChan(conn, &s.handlers)
+	s.handle(inbox, outbox, certUser)
+}
+
+// handle runs a client session. certUser is the common name of the client's
+// TLS certificate, if it presented one.
+func (s *ConnTapServer) handle(inbox <-chan *Tap, outbox chan<- *Tap, certUser string) {
+	authTap, token := s.login(inbox, outbox, certUser)
+	if authTap == nil {
+		close(outbox)
 		return
 	}
 
@@ -309,53 +1224,273 @@ func (s *ConnTapServer) handle(inbox <-chan *Tap, outbox chan<- *Tap) {
 		tapCursor, _ = strconv.Atoi(tapIdStr)
 	}
 
-	tapChan := make(chan bool, 1)
-
-	// register tapChan
-	s.tapChanLock.Lock()
-	oldTapChan := s.tapChans[user]
-	s.tapChans[user] = tapChan // in with the new
-	s.tapChanLock.Unlock()
-
-	// if another user was connected, kill them
-	if oldTapChan != nil {
-		oldTapChan <- false // out with the old
-	}
-
-	// deregister when we're done
-	defer func() {
-		s.tapChanLock.Lock()
-		if s.tapChans[user] == tapChan {
-			delete(s.tapChans, user)
-		}
-		s.tapChanLock.Unlock()
+	sess := newSession(user, s.config.SendQueue)
+	s.handlers.Add(1)
+	go func() {
+		defer s.handlers.Done()
+		sess.forward(outbox) // closes outbox once we close the queue
 	}()
+	defer close(sess.queue)
+	if !s.addSession(sess) {
+		s.send(sess, newShutdownTap(user))
+		return
+	}
+	defer s.removeSession(sess)
 
-	s.tapCore <- authTap
-	notify(tapChan) // prime the pump - effectively the 'catch up' tap
+	s.tapCore <- &submission{authTap, sess}
+	notify(sess.tapChan) // prime the pump - effectively the 'catch up' tap
+	hb := newHeartbeat(s.config.Heartbeat, s.config.IdleTimeout)
+	defer hb.stop()
 	for {
 		select {
 		case tap, ok := <-inbox:
 			if !ok {
 				return
 			}
+			hb.heard()
+			switch tap.Type {
+			case TYPE_PING:
+				if !s.send(sess, &Tap{Type: TYPE_PONG}) {
+					return
+				}
+				continue
+			case TYPE_PONG:
+				continue
+			case TYPE_AUTH, TYPE_REGISTER:
+				continue // already authenticated
+			case TYPE_LOGOUT:
+				err := s.tokens.Revoke(token)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error revoking token:", err)
+				}
+				return
+			case TYPE_REVOKE, TYPE_PASSWORD:
+				var err error
+				if tap.Type == TYPE_REVOKE {
+					err = s.revoke(user, tap.Args)
+				} else {
+					err = s.setPassword(user, tap.Args, tap.Secret)
+				}
+				if err != nil && !s.send(sess, &Tap{
+					Type:  TYPE_ERROR,
+					User:  user,
+					Value: err.Error(),
+				}) {
+					return
+				}
+				continue
+			}
 			tap.User = user
-			s.tapCore <- tap
-		case alive, ok := <-tapChan:
-			if !alive || !ok {
+			tap.Secret = ""
+			s.tapCore <- &submission{tap, sess}
+		case <-sess.kill:
+			// Pass on any last words, like a shutdown notice
+			for {
+				select {
+				case reply := <-sess.replies:
+					if !s.send(sess, reply) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-hb.C:
+			if !s.send(sess, &Tap{Type: TYPE_PING}) {
 				return
 			}
+		case <-hb.Idle:
+			if hb.isDead() {
+				fmt.Fprintf(os.Stderr, "Ending silent session of %s\n", user)
+				return
+			}
+		case reply := <-sess.replies:
+			if !s.send(sess, reply) {
+				return
+			}
+		case <-sess.tapChan:
 			// advance tap cursor
-			for ; tapCursor < len(s.data.Taps); tapCursor++ {
-				tap := s.data.Taps[tapCursor]
-				if s.isRelevant(user, tap) {
-					if s.isInvitingUser(user, tap) {
-						s.replayConversation(tap, outbox)
-					}
-					outbox <- tap
+			taps, next := s.store.UserTaps(user, tapCursor)
+			for _, tap := range taps {
+				if s.isInvitingUser(user, tap) && !s.replayConversation(tap, sess) {
+					return
+				}
+				if !s.send(sess, tap) {
+					return
 				}
 			}
+			tapCursor = next
+		}
+	}
+}
+
+// login waits for the client's auth (or register) tap and checks it,
+// replying directly on outbox. It returns the tap as it should be logged and
+// the session token presented, or a nil tap if the client is turned away.
+func (s *ConnTapServer) login(inbox <-chan *Tap, outbox chan<- *Tap, certUser string) (*Tap, string) {
+	// The first tap must be an auth (or register) tap
+	var authTap *Tap
+	var ok bool
+	var timeout <-chan time.Time
+	if s.config.IdleTimeout > 0 {
+		timeout = time.After(s.config.IdleTimeout)
+	}
+	select {
+	case authTap, ok = <-inbox:
+	case <-timeout:
+	case <-s.quit:
+	}
+	if !ok {
+		return nil, ""
+	}
+	if (authTap.Type != TYPE_AUTH && authTap.Type != TYPE_REGISTER) || authTap.User == "" {
+		outbox <- &Tap{
+			Type:  TYPE_ERROR,
+			Value: "First tap must be auth with valid user",
+		}
+		return nil, ""
+	}
+	if certUser != "" && certUser != authTap.User {
+		outbox <- &Tap{
+			Type:  TYPE_ERROR,
+			User:  authTap.User,
+			Value: "Client certificate does not match user",
+		}
+		return nil, ""
+	}
+	// Check the cursor first, so that a client turned away for it hasn't
+	// registered on the way
+	var token string
+	var err error
+	cursor, _ := strconv.Atoi(authTap.Value)
+	if cursor > s.store.Len() {
+		err = ErrBadCursor
+	} else {
+		token, err = s.authenticate(authTap)
+	}
+	if err == nil && token == "" {
+		// logged in with a password: hand out a token for next time
+		var expires time.Time
+		token, expires, err = s.tokens.Issue(authTap.User)
+		if err == nil {
+			outbox <- &Tap{
+				Type:  TYPE_TOKEN,
+				User:  authTap.User,
+				Value: token,
+				Args:  []string{expires.Format(time.RFC3339)},
+			}
+		}
+	}
+	if err != nil {
+		outbox <- &Tap{
+			Type:  TYPE_ERROR,
+			User:  authTap.User,
+			Value: err.Error(),
+		}
+		return nil, ""
+	}
+	return authTap, token
+}
+
+// authenticate checks the password or session token on an auth tap, or
+// registers the user for a register tap, and turns it into a plain auth tap
+// fit for the tap log. It returns the session token the tap presented, if
+// any.
+func (s *ConnTapServer) authenticate(authTap *Tap) (token string, err error) {
+	switch {
+	case authTap.Type == TYPE_REGISTER && strarr.Contains(s.config.Admins, authTap.User):
+		err = ErrNameReserved // admins get their passwords from setPassword
+	case authTap.Type == TYPE_REGISTER:
+		if !s.credentials.Has(authTap.User) && s.store.LoggedIn(authTap.User) {
+			// Someone from before passwords: whoever registered the name
+			// would take over their conversations
+			err = ErrNameInUse
+		} else {
+			err = s.credentials.Register(authTap.User, authTap.Secret)
+		}
+	case authTap.Token != "":
+		token = authTap.Token
+		err = s.tokens.Verify(authTap.User, token)
+	default:
+		err = s.credentials.Verify(authTap.User, authTap.Secret)
+	}
+	authTap.Type = TYPE_AUTH
+	authTap.Secret = ""
+	authTap.Token = ""
+	return
+}
+
+// revoke kills every session token of the given users and disconnects them.
+// Only admins may revoke.
+func (s *ConnTapServer) revoke(admin string, users []string) error {
+	if !strarr.Contains(s.config.Admins, admin) {
+		return errors.New("Only admins may revoke tokens")
+	}
+	for _, user := range users {
+		revoked, err := s.tokens.RevokeUser(user)
+		if err != nil {
+			return err
 		}
+		fmt.Printf("%s revoked %d tokens of %s\n", admin, revoked, user)
+		s.endSessions(user)
+	}
+	return nil
+}
+
+// setPassword gives a user a password, as for users who logged in before
+// there were passwords. Only admins may set passwords.
+func (s *ConnTapServer) setPassword(admin string, args []string, secret string) error {
+	if !strarr.Contains(s.config.Admins, admin) {
+		return errors.New("Only admins may set passwords")
+	}
+	if len(args) != 1 {
+		return errors.New("User and password required")
+	}
+	err := s.credentials.SetPassword(args[0], secret)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s set the password of %s\n", admin, args[0])
+	return nil
+}
+
+// addSession registers a new session, unless the server is shutting down.
+func (s *ConnTapServer) addSession(sess *session) bool {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if s.closing {
+		return false
+	}
+	sessions := s.sessions[sess.user]
+	if sessions == nil {
+		sessions = make(map[*session]bool)
+		s.sessions[sess.user] = sessions
+	}
+	if s.config.SingleSession {
+		for old, _ := range sessions {
+			old.end() // out with the old
+			delete(sessions, old)
+		}
+	}
+	sessions[sess] = true // in with the new
+	return true
+}
+
+func (s *ConnTapServer) removeSession(sess *session) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	sessions := s.sessions[sess.user]
+	delete(sessions, sess)
+	if len(sessions) == 0 {
+		delete(s.sessions, sess.user)
+	}
+}
+
+func (s *ConnTapServer) endSessions(user string) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	for sess, _ := range s.sessions[user] {
+		sess.end()
 	}
 }
 
@@ -363,25 +1498,74 @@ func (s *ConnTapServer) isInvitingUser(user string, tap *Tap) bool {
 	return tap.Type == TYPE_INVITE && strarr.Contains(tap.Args, user)
 }
 
-func (s *ConnTapServer) replayConversation(inviteTap *Tap, outbox chan<- *Tap) {
+func (s *ConnTapServer) replayConversation(inviteTap *Tap, sess *session) bool {
 	fmt.Printf("Replaying conversation: %s\n", inviteTap.Conversation)
-	for tapCursor := 0; tapCursor < inviteTap.Id; tapCursor++ {
-		tap := s.data.Taps[tapCursor]
-		if tap.Conversation == inviteTap.Conversation {
-			fmt.Printf("Replay: %s\n", tap.Type)
-			outbox <- tap
+	for _, tap := range s.store.ConversationTaps(inviteTap.Conversation, inviteTap.Id) {
+		if tap.Type == TYPE_READ && tap.User != sess.user {
+			continue // what others have read is their business
+		}
+		fmt.Printf("Replay: %s\n", tap.Type)
+		if !s.send(sess, tap) {
+			return false
+		}
+	}
+	return true
+}
+
+// send queues a tap for the session's client, waiting up to SendTimeout for
+// room. It returns false if the client has fallen too far behind, in which
+// case the session must end.
+func (s *ConnTapServer) send(sess *session, tap *Tap) bool {
+	select {
+	case sess.queue <- tap:
+		return true
+	default:
+	}
+	timer := time.NewTimer(s.config.SendTimeout)
+	defer timer.Stop()
+	select {
+	case sess.queue <- tap:
+		return true
+	case <-timer.C:
+	}
+
+	atomic.AddInt64(&s.slowConsumers, 1)
+	fmt.Fprintf(os.Stderr, "Disconnecting %s: %d taps behind\n", sess.user, len(sess.queue))
+	if s.config.SlowConsumer == SLOW_DISCONNECT {
+		// Nothing queued matters now, so make room to say why
+	drain:
+		for {
+			select {
+			case <-sess.queue:
+			default:
+				break drain
+			}
 		}
+		sess.queue <- &Tap{Type: TYPE_ERROR, User: sess.user, Value: ErrTooSlow.Error()}
 	}
+	return false
 }
 
 func (s *ConnTapServer) isRelevant(user string, tap *Tap) bool {
+	return isRelevant(user, tap, s.store.Membership(tap.Conversation, user))
+}
+
+// isRelevant reports whether user should receive tap, given the id of the
+// tap that made them a member of its conversation (0 if they are not one).
+func isRelevant(user string, tap *Tap, membershipId int) bool {
 	switch tap.Type {
 	case TYPE_AUTH:
 		return true
-	case TYPE_CONVERSATION, TYPE_MESSAGE, TYPE_INVITE:
+	case TYPE_CONVERSATION, TYPE_MESSAGE, TYPE_INVITE, TYPE_RENAME, TYPE_TOPIC,
+		TYPE_EDIT, TYPE_DELETE, TYPE_REACT:
 		// User must be in conversation AND must have been joined prior to this tap
-		membershipId := s.data.Conversations[tap.Conversation].Users[user]
 		return membershipId > 0 && membershipId <= tap.Id
+	case TYPE_LEAVE:
+		// The leaver is no longer a member but still needs to hear about it
+		return tap.User == user || (membershipId > 0 && membershipId <= tap.Id)
+	case TYPE_READ:
+		// Only the reader's own sessions need to know
+		return tap.User == user && membershipId > 0 && membershipId <= tap.Id
 	default:
 		return false
 	}
@@ -396,72 +1580,403 @@ func notify(tapChan chan<- bool) {
 
 // ===== Client ==============================================================
 
+const (
+	DIAL_TIMEOUT = 10 * time.Second
+	MIN_BACKOFF  = 250 * time.Millisecond
+	MAX_BACKOFF  = 30 * time.Second
+)
+
 func connTapClient(args []string) {
-	commander.CheckArgs(args, 1, "Usage: tcptap connTapClient <host:port>")
+	flags := flag.NewFlagSet("connTapClient", flag.ExitOnError)
+	register := flags.Bool("register", false, "register a new account")
+	useTLS := flags.Bool("tls", false, "connect with TLS")
+	caFile := flags.String("ca", "", "CA file to verify the server with (implies -tls)")
+	certFile := flags.String("cert", "", "client certificate file for mutual TLS (implies -tls)")
+	keyFile := flags.String("key", "", "client private key file for mutual TLS")
+	heartbeat := flags.Duration("heartbeat", HEARTBEAT_INTERVAL, "how often to ping the server (0 to disable)")
+	idleTimeout := flags.Duration("idle-timeout", IDLE_TIMEOUT, "how long the server may be silent before reconnecting (0 to disable)")
+	times := flags.String("times", "relative", "show message times as relative or absolute")
+	dir := flags.String("dir", filepath.Join(os.Getenv("HOME"), ".tcptap"),
+		"directory to keep unsent taps and cached data in")
+	flags.Parse(args)
+	commander.CheckArgs(flags.Args(), 1,
+		"Usage: tcptap connTapClient [-register] [-tls] [-ca <file>] [-cert <file> -key <file>] [-heartbeat <interval>] [-idle-timeout <timeout>] [-times relative|absolute] [-dir <dir>] <host:port>")
+	service := flags.Arg(0)
 	name, _ := commander.Prompt("Please enter your name: ")
-	NewConnTapClient(name).connect(args[0])
+	password, _ := commander.Prompt("Password: ")
+	client := NewConnTapClient(name, password)
+	client.register = *register
+	client.heartbeat, client.idleTimeout = *heartbeat, *idleTimeout
+	absoluteTimes, err := parseTimes(*times)
+	gobro.CheckErr(err)
+	client.absoluteTimes = absoluteTimes
+	err = os.MkdirAll(*dir, 0700)
+	gobro.CheckErr(err)
+	client.pending, err = OpenOutbox(clientFile(*dir, service, name, "outbox"))
+	gobro.CheckErr(err)
+	client.cachePath = clientFile(*dir, service, name, "cache")
+	data, cursor, err := LoadClientCache(client.cachePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Ignoring client cache:", err)
+	} else {
+		client.data, client.cursor = data, cursor
+	}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		client.tlsConfig, err = ClientTLSConfig(*caFile, *certFile, *keyFile)
+		gobro.CheckErr(err)
+	}
+	client.connect(service)
+}
+
+// clientFile names one of the files a client keeps for a user on a server
+func clientFile(dir, service, user, kind string) string {
+	name := fmt.Sprintf("%s@%s.%s.json", user, service, kind)
+	return filepath.Join(dir, strings.NewReplacer(":", "_", "/", "_").Replace(name))
 }
 
 type ConnTapClient struct {
 	user           string
+	secret         string
+	token          string
+	register       bool
+	requestPrefix  string
+	requestCount   int
+	pending        *Outbox // sent but not yet acked
+	cursor         int     // id of the next tap we expect from the server
+	cachePath      string
+	cacheDirty     bool
+	heartbeat      time.Duration
+	idleTimeout    time.Duration
+	tlsConfig      *tls.Config
+	err            string
 	data           *Data
 	conversation   *Conversation
+	thread         int            // tap id of the thread being viewed, if any
+	marked         map[string]int // the last read marker sent, by conversation
 	userToSync     chan *Tap
 	syncToUser     chan *Tap
+	statusToUser   chan string
+	status         string
 	isViewingUsers bool
 	isViewingHelp  bool
+	absoluteTimes  bool       // show message times as clock times rather than ages
+	lock           sync.Mutex // guards data, which the sync goroutine updates
 }
 
-func NewConnTapClient(user string) *ConnTapClient {
+func NewConnTapClient(user, secret string) *ConnTapClient {
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
 	return &ConnTapClient{
-		user:       user,
-		data:       NewData(),
-		userToSync: make(chan *Tap),
-		syncToUser: make(chan *Tap),
+		user:          user,
+		secret:        secret,
+		requestPrefix: hex.EncodeToString(prefix),
+		pending:       NewOutbox(),
+		heartbeat:     HEARTBEAT_INTERVAL,
+		idleTimeout:   IDLE_TIMEOUT,
+		data:          NewData(),
+		marked:        make(map[string]int),
+		userToSync:    make(chan *Tap),
+		syncToUser:    make(chan *Tap),
+		statusToUser:  make(chan string, 16),
 	}
 }
 
 func (c *ConnTapClient) connect(service string) {
-	c.print("Connecting...")
-	conn, err := net.Dial("tcp", service)
-	gobro.CheckErr(err)
-	defer conn.Close()
-	c.print("Connected!")
-
-	inbox, outbox := connToChan(conn)
-	go c.sync(inbox, outbox)
+	go c.run(service)
 	c.handle()
 }
 
-func (c *ConnTapClient) sync(inbox <-chan *Tap, outbox chan<- *Tap) {
-	defer close(outbox)
+var (
+	errQuit      = errors.New("Goodbye")
+	errLoggedOut = errors.New("Logged out")
+	errDropped   = errors.New("Connection closed before login")
+)
+
+// run keeps the client connected to service, reconnecting with exponential
+// backoff whenever the connection drops, until the user quits or the server
+// turns us away.
+func (c *ConnTapClient) run(service string) {
 	defer close(c.syncToUser)
 
-	// Authentication
-	outbox <- NewTap(TYPE_AUTH, c.user, "", "0")
+	backoff := MIN_BACKOFF
+	for {
+		c.setStatus("Connecting...")
+		conn, err := c.dial(service)
+		if err == nil {
+			c.setStatus("")
+			err = c.sync(connToChan(conn, nil))
+		}
+		switch {
+		case err == nil:
+			backoff = MIN_BACKOFF // we were logged in, so start over
+		case err == errQuit:
+			return
+		case err == errLoggedOut:
+			c.setStatus(err.Error())
+			return
+		case err == errDropped:
+		case err.Error() == ErrBadToken.Error():
+			continue // try again right away with the password
+		case err.Error() == ErrBadCursor.Error():
+			continue // try again right away from scratch
+		default:
+			if _, ok := err.(net.Error); !ok {
+				// turned away by the server or by TLS; retrying won't help
+				c.setStatus("Login failed: " + err.Error())
+				return
+			}
+		}
+
+		// Wait it out, keeping the user informed
+		c.setStatus(fmt.Sprintf("Disconnected, retrying in %s", backoff))
+		retry := time.After(backoff)
+	waiting:
+		for {
+			select {
+			case <-retry:
+				break waiting
+			case tap, ok := <-c.userToSync:
+				if !ok {
+					return
+				}
+				if !isQueueable(tap) {
+					c.setStatus(fmt.Sprintf("Not connected, %s not sent", tap.Type))
+					continue
+				}
+				c.track(tap)
+				c.lock.Lock()
+				queued := c.pending.Len()
+				c.lock.Unlock()
+				c.setStatus(fmt.Sprintf("Not connected, %d waiting to be sent", queued))
+			}
+		}
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+}
+
+func (c *ConnTapClient) dial(service string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DIAL_TIMEOUT}
+	if c.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", service, c.tlsConfig)
+	}
+	return dialer.Dial("tcp", service)
+}
+
+// setStatus shows a connection status in the header. It never blocks.
+func (c *ConnTapClient) setStatus(status string) {
+	select {
+	case c.statusToUser <- status:
+	default:
+	}
+}
+
+// sync runs one connection to the server. It returns nil if we were logged
+// in when the connection dropped.
+func (c *ConnTapClient) sync(inbox <-chan *Tap, outbox chan<- *Tap) error {
+	defer close(outbox)
+	defer c.saveCache()
+	cacheTicker := time.NewTicker(CACHE_INTERVAL)
+	defer cacheTicker.Stop()
+	hb := newHeartbeat(c.heartbeat, c.idleTimeout)
+	defer hb.stop()
+
+	// Authentication, picking up where we left off
+	c.lock.Lock()
+	authTap := NewTap(TYPE_AUTH, c.user, "", strconv.Itoa(c.cursor))
+	c.lock.Unlock()
+	if c.register {
+		authTap.Type = TYPE_REGISTER
+	}
+	if c.token != "" {
+		authTap.Token = c.token
+	} else {
+		authTap.Secret = c.secret
+	}
+	outbox <- authTap
+
+	// then whatever we could not send before, in order
+	c.lock.Lock()
+	queued := c.pending.Taps()
+	c.lock.Unlock()
+	for _, tap := range queued {
+		outbox <- tap
+	}
+	loggedIn := false
+	var rejected error
 
 	// Listen loop
 	for {
 		select {
 		case tap, ok := <-inbox:
 			if !ok {
-				return
+				if loggedIn {
+					return nil
+				}
+				if rejected != nil {
+					return rejected
+				}
+				return errDropped
 			}
 			// fmt.Printf("%s received: %s\n", c.user, tap.Type)
-			err := c.data.Update(tap)
-			if err != nil {
-				// fmt.Printf("%s encountered error processing %s: %s\n",
-				// c.user, tap.Type, err.Error())
+			hb.heard()
+			switch tap.Type {
+			case TYPE_PING:
+				outbox <- &Tap{Type: TYPE_PONG}
+				continue
+			case TYPE_PONG:
+				continue
+			}
+			if tap.Type == TYPE_ERROR && !loggedIn {
+				rejected = errors.New(tap.Value)
+			} else {
+				loggedIn = true
+			}
+			if !c.apply(tap) {
 				continue
 			}
 			c.syncToUser <- tap
 		case tap, ok := <-c.userToSync:
 			if !ok {
-				return
+				return errQuit
+			}
+			switch tap.Type {
+			case TYPE_LOGOUT:
+				c.token = ""
+				outbox <- tap
+				return errLoggedOut
+			case TYPE_REVOKE, TYPE_PASSWORD:
+				// handled by the session itself, never acked
+			default:
+				c.track(tap)
 			}
 			outbox <- tap
+		case <-cacheTicker.C:
+			c.saveCache()
+		case <-hb.C:
+			outbox <- &Tap{Type: TYPE_PING}
+		case <-hb.Idle:
+			if hb.isDead() {
+				if loggedIn {
+					return nil
+				}
+				return errDropped
+			}
+		}
+	}
+}
+
+// saveCache writes our data and cursor to the cache, if we have one and
+// anything has changed since the last time.
+func (c *ConnTapClient) saveCache() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cachePath == "" || !c.cacheDirty {
+		return
+	}
+	err := SaveClientCache(c.cachePath, c.data, c.cursor)
+	if err != nil {
+		c.setStatus("Could not save cache: " + err.Error())
+		return
+	}
+	c.cacheDirty = false
+}
+
+// track gives an outgoing tap a request id and remembers it until the server
+// acks it.
+func (c *ConnTapClient) track(tap *Tap) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if tap.Request == "" {
+		c.requestCount++
+		tap.Request = fmt.Sprintf("%s-%d", c.requestPrefix, c.requestCount)
+	}
+	err := c.pending.Add(tap)
+	if err != nil {
+		c.setStatus("Could not save outbox: " + err.Error())
+	}
+}
+
+// unqueue drops a tap from the outbox once the server has dealt with it.
+// It must be called with the lock held.
+func (c *ConnTapClient) unqueue(request string) {
+	if request == "" {
+		return
+	}
+	_, err := c.pending.Remove(request)
+	if err != nil {
+		c.setStatus("Could not save outbox: " + err.Error())
+	}
+}
+
+// isQueueable says whether a tap may wait in the outbox while we are offline
+func isQueueable(tap *Tap) bool {
+	switch tap.Type {
+	case TYPE_MESSAGE, TYPE_CONVERSATION, TYPE_INVITE, TYPE_RENAME, TYPE_TOPIC,
+		TYPE_EDIT, TYPE_DELETE, TYPE_REACT, TYPE_READ:
+		return true
+	}
+	return false
+}
+
+// apply updates the client's data with a tap from the server and reports
+// whether the user needs to hear about it.
+func (c *ConnTapClient) apply(tap *Tap) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch tap.Type {
+	case TYPE_TOKEN:
+		c.token = tap.Value
+		return false
+	case TYPE_ACK:
+		c.unqueue(tap.Request)
+		return false
+	case TYPE_SHUTDOWN:
+		c.setStatus(tap.Value)
+		return false
+	case TYPE_ERROR:
+		if tap.Value == ErrBadToken.Error() {
+			c.token = "" // fall back to the password
+		}
+		if tap.Value == ErrBadCursor.Error() {
+			// throw away what we have cached
+			c.data = NewData()
+			c.cursor = 0
+			c.cacheDirty = true
+		}
+		c.unqueue(tap.Request)
+		return true
+	case TYPE_AUTH:
+		if tap.User == c.user {
+			c.register = false // registered; log in from now on
+		}
+	}
+	if tap.Id >= c.cursor {
+		c.cursor = tap.Id + 1
+		c.cacheDirty = true
+	}
+	if tap.User == c.user {
+		c.unqueue(tap.Request) // no need to wait for the ack
+	}
+	switch tap.Type {
+	case TYPE_CONVERSATION:
+		// We are being re-invited to a conversation we left and it is
+		// about to be replayed from the start
+		old := c.data.Conversations[tap.Conversation]
+		if old != nil && !old.HasUser(c.user) {
+			delete(c.data.Conversations, tap.Conversation)
 		}
 	}
+	err := c.data.Update(tap)
+	if err != nil {
+		// fmt.Printf("%s encountered error processing %s: %s\n",
+		// c.user, tap.Type, err.Error())
+		return false
+	}
+	return true
 }
 
 func (c *ConnTapClient) handle() {
@@ -484,15 +1999,26 @@ func (c *ConnTapClient) handle() {
 
 	for {
 		select {
-		case _, ok := <-c.syncToUser:
+		case tap, ok := <-c.syncToUser:
 			if !ok {
+				c.lock.Lock()
 				c.print("Server has closed connection")
+				c.lock.Unlock()
 				return
 			}
+			if tap.Type == TYPE_ERROR {
+				c.err = tap.Value
+			}
+			c.updateView()
+		case status := <-c.statusToUser:
+			c.status = status
 			c.updateView()
 		case cmd, ok := <-prompt:
 			if !ok {
+				c.saveCache()
+				c.lock.Lock()
 				c.print("Goodbye")
+				c.lock.Unlock()
 				return
 			}
 			c.handleCmd(cmd)
@@ -503,6 +2029,7 @@ func (c *ConnTapClient) handle() {
 func (c *ConnTapClient) handleCmd(message string) {
 	c.isViewingUsers = false
 	c.isViewingHelp = false
+	c.err = ""
 
 	parts := strings.SplitN(message, " ", 2)
 	cmd := parts[0]
@@ -511,11 +2038,40 @@ func (c *ConnTapClient) handleCmd(message string) {
 		val = parts[1]
 	}
 
+	switch cmd {
+	case "logout":
+		c.userToSync <- &Tap{Type: TYPE_LOGOUT}
+		return
+	case "revoke":
+		users := strings.Split(val, ",")
+		strarr.TrimAll(users)
+		c.userToSync <- &Tap{Type: TYPE_REVOKE, Args: users}
+		return
+	case "password":
+		args := strings.Fields(val)
+		if len(args) != 2 {
+			c.err = "Give the user and their new password"
+			return
+		}
+		c.userToSync <- &Tap{Type: TYPE_PASSWORD, Args: args[:1], Secret: args[1]}
+		return
+	case "times":
+		absolute, err := parseTimes(val)
+		if err != nil {
+			c.err = err.Error()
+		} else {
+			c.absoluteTimes = absolute
+		}
+		c.updateView()
+		return
+	}
+
 	if c.conversation == nil {
 		switch cmd {
 		case "help":
 			c.printHelp(true)
 		case "exit":
+			c.saveCache()
 			os.Exit(0)
 		case "users":
 			c.printUsers(true)
@@ -526,6 +2082,14 @@ func (c *ConnTapClient) handleCmd(message string) {
 			c.printInbox(true)
 		case "open":
 			c.openConversation(val)
+		case "leave":
+			conversation, err := c.findConversation(val)
+			if err != nil {
+				c.err = err.Error()
+			} else {
+				c.leaveConversation(conversation.Id)
+			}
+			c.printInbox(true)
 		default:
 			c.printHelp(true)
 		}
@@ -534,20 +2098,89 @@ func (c *ConnTapClient) handleCmd(message string) {
 		case "help":
 			c.printHelp(true)
 		case "exit":
+			c.saveCache()
 			os.Exit(0)
 		case "users":
 			c.printUsers(true)
 		case "invite":
 			c.inviteUsers(val)
 			c.printMessages(true)
+		case "rename":
+			c.userToSync <- &Tap{
+				Type:         TYPE_RENAME,
+				Conversation: c.conversation.Id,
+				Args:         []string{val},
+			}
+			c.printMessages(true)
+		case "topic":
+			c.userToSync <- &Tap{
+				Type:         TYPE_TOPIC,
+				Conversation: c.conversation.Id,
+				Args:         []string{val},
+			}
+			c.printMessages(true)
+		case "edit", "delete":
+			tapId, body, err := c.findMessage(val)
+			if err != nil {
+				c.err = err.Error()
+			} else {
+				c.userToSync <- &Tap{
+					Type:         cmd,
+					Conversation: c.conversation.Id,
+					Value:        body,
+					Args:         []string{strconv.Itoa(tapId)},
+				}
+			}
+			c.printMessages(true)
+		case "reply":
+			tapId, body, ok := splitMessageId(val)
+			if !ok {
+				c.err = "Say which message to reply to by its #id"
+			} else {
+				c.userToSync <- &Tap{
+					Type:         TYPE_MESSAGE,
+					Conversation: c.conversation.Id,
+					Value:        body,
+					Parent:       tapId,
+				}
+			}
+			c.printMessages(true)
+		case "thread":
+			c.openThread(val)
+			c.printMessages(true)
+		case "react":
+			tapId, reaction, ok := splitMessageId(val)
+			if !ok {
+				c.err = "Say which message to react to by its #id"
+			} else {
+				c.userToSync <- &Tap{
+					Type:         TYPE_REACT,
+					Conversation: c.conversation.Id,
+					Value:        reaction,
+					Args:         []string{strconv.Itoa(tapId)},
+				}
+			}
+			c.printMessages(true)
 		case "close":
+			if c.thread != 0 {
+				c.thread = 0
+				c.printMessages(true)
+				return
+			}
+			c.markRead() // what arrived while it was open
 			c.conversation = nil
 			c.printInbox(true)
+		case "leave":
+			c.leaveConversation(c.conversation.Id)
+			c.conversation = nil
+			c.thread = 0
+			c.printInbox(true)
 		default:
 			c.userToSync <- &Tap{
 				Type:         TYPE_MESSAGE,
-				Conversation: c.conversation.Title,
+				Conversation: c.conversation.Id,
 				Value:        message,
+				Parent:       c.thread,
 			}
 			c.printMessages(true)
 		}
@@ -559,11 +2192,18 @@ func (c *ConnTapClient) inviteUsers(args string) {
 	strarr.TrimAll(users)
 	c.userToSync <- &Tap{
 		Type:         TYPE_INVITE,
-		Conversation: c.conversation.Title,
+		Conversation: c.conversation.Id,
 		Args:         users,
 	}
 }
 
+func (c *ConnTapClient) leaveConversation(id string) {
+	c.userToSync <- &Tap{
+		Type:         TYPE_LEAVE,
+		Conversation: id,
+	}
+}
+
 func (c *ConnTapClient) createConversation(args string) {
 	titleAndUsers := strings.SplitN(args, ":", 2)
 	title := strings.Trim(titleAndUsers[0], " ")
@@ -573,23 +2213,113 @@ func (c *ConnTapClient) createConversation(args string) {
 		strarr.TrimAll(users)
 	}
 
-	c.userToSync <- &Tap{
-		Type:         TYPE_CONVERSATION,
-		Conversation: title,
-		Args:         users,
+	c.userToSync <- NewConversationTap(c.user, title, users...)
+}
+
+// splitMessageId splits a message's "#id" off the front of val
+func splitMessageId(val string) (tapId int, rest string, ok bool) {
+	val = strings.TrimSpace(val)
+	if !strings.HasPrefix(val, "#") {
+		return 0, val, false
+	}
+	parts := strings.SplitN(val[1:], " ", 2)
+	tapId, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, val, false
+	}
+	if len(parts) == 2 {
+		rest = strings.TrimSpace(parts[1])
 	}
+	return tapId, rest, true
 }
 
-func (c *ConnTapClient) openConversation(title string) {
-	c.conversation = c.data.Conversations[title]
-	if c.conversation == nil {
-		c.print("Conversation %s not found", title)
-	} else {
-		c.printMessages(true)
+// findMessage splits the id of the message to change off the front of val,
+// or else picks the user's last message in the conversation.
+func (c *ConnTapClient) findMessage(val string) (tapId int, rest string, err error) {
+	tapId, rest, ok := splitMessageId(val)
+	if ok {
+		return tapId, rest, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i := len(c.conversation.Messages) - 1; i >= 0; i-- {
+		m := c.conversation.Messages[i]
+		if m.User == c.user && m.Type == TYPE_MESSAGE && !m.Deleted {
+			return m.TapId, rest, nil
+		}
+	}
+	return 0, "", errors.New("You have no message here to change")
+}
+
+// openThread views the thread of the message with the given "#id"
+func (c *ConnTapClient) openThread(val string) {
+	tapId, _, ok := splitMessageId(val)
+	if !ok {
+		c.err = "Say which thread to open by the #id of a message in it"
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	m := c.conversation.Message(tapId)
+	if m == nil || m.Type != TYPE_MESSAGE {
+		c.err = fmt.Sprintf("Message %d not found", tapId)
+		return
 	}
+	if m.Parent != 0 {
+		tapId = m.Parent
+	}
+	c.thread = tapId
+}
+
+func (c *ConnTapClient) openConversation(name string) {
+	conversation, err := c.findConversation(name)
+	if err != nil {
+		c.lock.Lock()
+		c.print("%s", err.Error())
+		c.lock.Unlock()
+		return
+	}
+	c.conversation = conversation
+	c.markRead()
+	c.printMessages(true)
+}
+
+// findConversation looks up one of the user's conversations by title, or by
+// id written as #id when several share a title.
+func (c *ConnTapClient) findConversation(name string) (*Conversation, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	name = strings.Trim(name, " ")
+	if strings.HasPrefix(name, "#") {
+		conversation := c.data.Conversations[name[1:]]
+		if conversation != nil && conversation.HasUser(c.user) {
+			return conversation, nil
+		}
+	}
+	var found *Conversation
+	for _, conversation := range c.data.Conversations {
+		if conversation.Title != name || !conversation.HasUser(c.user) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("There are several conversations called %s; use its #id", name)
+		}
+		found = conversation
+	}
+	if found == nil {
+		return nil, fmt.Errorf("Conversation %s not found", name)
+	}
+	return found, nil
 }
 
 func (c *ConnTapClient) updateView() {
+	c.lock.Lock()
+	if c.conversation != nil && (!c.conversation.HasUser(c.user) ||
+		c.data.Conversations[c.conversation.Id] != c.conversation) {
+		c.conversation = nil // we left it, or our data started over
+		c.thread = 0
+	}
+	c.lock.Unlock()
 	if c.isViewingUsers {
 		c.printUsers(false)
 	} else if c.isViewingHelp {
@@ -602,37 +2332,156 @@ func (c *ConnTapClient) updateView() {
 }
 
 func (c *ConnTapClient) printInbox(clearView bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries := make(byUnread, 0, len(c.data.Conversations))
+	for _, conversation := range c.data.Conversations {
+		if conversation.HasUser(c.user) {
+			entries = append(entries, inboxEntry{conversation, conversation.Unread(c.user)})
+		}
+	}
+	sort.Sort(entries)
 	inbox := make([]string, 0, 20)
-	for title, conversation := range c.data.Conversations {
-		inbox = append(inbox, title+"\n  "+conversation.LastMessage().String())
+	for _, entry := range entries {
+		last := entry.conversation.LastMessage()
+		line := fmt.Sprintf("%s  #%s  %s", entry.conversation.Title, entry.conversation.Id,
+			c.formatTime(last.Time))
+		if entry.unread > 0 {
+			line += fmt.Sprintf("  (%d unread)", entry.unread)
+		}
+		inbox = append(inbox, fmt.Sprintf("%s\n  %s", line, last))
 		if len(inbox) == 18 {
 			break
 		}
 	}
 	content := strings.Join(inbox, "\n")
 	if clearView {
-		c.print(content)
+		c.print("%s", content)
 	} else {
-		c.updateContent(content)
+		c.updateContent("%s", content)
+	}
+}
+
+type inboxEntry struct {
+	conversation *Conversation
+	unread       int
+}
+
+// byUnread puts conversations with unread messages first, then the most
+// recently active.
+type byUnread []inboxEntry
+
+func (b byUnread) Len() int      { return len(b) }
+func (b byUnread) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byUnread) Less(i, j int) bool {
+	if (b[i].unread > 0) != (b[j].unread > 0) {
+		return b[i].unread > 0
 	}
+	return b[i].conversation.LastMessage().TapId > b[j].conversation.LastMessage().TapId
+}
+
+// markRead tells the server, and so the user's other sessions, that the user
+// has seen the open conversation up to its last message. Every marker is a
+// tap the server keeps, so it is only called on opening and closing a
+// conversation rather than on every refresh.
+func (c *ConnTapClient) markRead() {
+	c.lock.Lock()
+	id := c.conversation.Id
+	last := c.conversation.LastMessage().TapId
+	unread := c.conversation.Unread(c.user) > 0 && last > c.marked[id]
+	c.lock.Unlock()
+	if !unread {
+		return
+	}
+	c.userToSync <- &Tap{Type: TYPE_READ, Conversation: id, Args: []string{strconv.Itoa(last)}}
+	c.marked[id] = last
 }
 
 func (c *ConnTapClient) printMessages(clearView bool) {
-	messages := make([]string, 0, 20)
-	start := len(c.conversation.Messages) - 20
-	start = gobro.Max(start, 0)
-	for _, message := range c.conversation.Messages[start:] {
-		messages = append(messages, message.String())
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	root := c.conversation.Message(c.thread)
+	if root == nil {
+		c.thread = 0 // the conversation was replayed from scratch
+	}
+	// The conversation shows its topic and the messages that start threads;
+	// a thread shows the message that started it and the replies
+	heading := ""
+	lines := make([]string, 0, 20)
+	if c.thread != 0 {
+		heading = c.messageLine(root)
+		for _, tapId := range root.Replies {
+			lines = append(lines, "  "+c.messageLine(c.conversation.Message(tapId)))
+		}
+	} else {
+		if c.conversation.Topic != "" {
+			heading = "Topic: " + c.conversation.Topic
+		}
+		for _, message := range c.conversation.Messages {
+			if message.Parent == 0 {
+				lines = append(lines, c.messageLine(message))
+			}
+		}
+	}
+	for _, tap := range c.pending.Taps() {
+		if tap.Type == TYPE_MESSAGE && tap.Conversation == c.conversation.Id &&
+			tap.Parent == c.thread {
+			lines = append(lines, fmt.Sprintf("%s: %s  (pending)", c.user, tap.Value))
+		}
 	}
-	content := strings.Join(messages, "\n")
+	lines = lines[gobro.Max(len(lines)-20, 0):]
+	if heading != "" {
+		if len(lines) == 20 {
+			lines = lines[1:]
+		}
+		lines = append([]string{heading}, lines...)
+	}
+	content := strings.Join(lines, "\n")
 	if clearView {
-		c.print(content)
+		c.print("%s", content)
 	} else {
-		c.updateContent(content)
+		c.updateContent("%s", content)
+	}
+}
+
+// messageLine shows a message with its id, when it was said and how many
+// replies it has had
+func (c *ConnTapClient) messageLine(m *Message) string {
+	line := fmt.Sprintf("#%d  ", m.TapId)
+	if !m.Time.IsZero() {
+		line += c.formatTime(m.Time) + "  "
+	}
+	line += m.String()
+	if len(m.Reactions) > 0 {
+		line += "  " + reactionSummary(m.Reactions)
+	}
+	switch len(m.Replies) {
+	case 0:
+	case 1:
+		line += "  [1 reply]"
+	default:
+		line += fmt.Sprintf("  [%d replies]", len(m.Replies))
+	}
+	return line
+}
+
+// reactionSummary counts each reaction, e.g. "+1 x3  heart x1"
+func reactionSummary(reactions map[string][]string) string {
+	names := make([]string, 0, len(reactions))
+	for reaction, _ := range reactions {
+		names = append(names, reaction)
+	}
+	sort.Strings(names)
+	counts := make([]string, len(names))
+	for i, reaction := range names {
+		counts[i] = fmt.Sprintf("%s x%d", reaction, len(reactions[reaction]))
 	}
+	return strings.Join(counts, "  ")
 }
 
 func (c *ConnTapClient) printUsers(clearView bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.isViewingUsers = true
 	header := "All users:"
 	userSet := c.data.Users
@@ -646,39 +2495,54 @@ func (c *ConnTapClient) printUsers(clearView bool) {
 	}
 	content := fmt.Sprintf("%s\n  %s", header, strings.Join(users, "\n  "))
 	if clearView {
-		c.print(content)
+		c.print("%s", content)
 	} else {
-		c.updateContent(content)
+		c.updateContent("%s", content)
 	}
 
 }
 
 func (c *ConnTapClient) printHelp(clearView bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	c.isViewingHelp = true
 	content := `Available Commands:
 
   From the inbox:
-    inbox: show the inbox
+    inbox: show the inbox, unread conversations first
     create <title> [:<participants>, ...]: create a conversation
     	To include participants, put ':' followed by comma-separated list of users.
     	For example:
     	$ create Good Apples: John Apple, Fred Pear, Bob Watermelon
     open <title>: open a conversation in the window
+    	If several conversations share a title, use the #id shown in the inbox instead.
     users: show all users
     leave <title>: leave a conversation
   From a conversation:
     users: show users in conversation
     invite <participants>: invite list of comma-separated participants to conversation
-    close: close the current conversation (go back to the inbox)
+    rename <title>: rename the current conversation
+    topic [<topic>]: set the topic of the current conversation, or clear it
+    edit [#<id>] <message>: change your last message, or the one with the given id
+    delete [#<id>]: delete your last message, or the one with the given id
+    reply #<id> <message>: reply to a message, starting or joining its thread
+    thread #<id>: show the thread of a message; what you say there is a reply
+    react #<id> <reaction>: react to a message, or take your reaction back
+    leave: leave the current conversation
+    close: close the current thread or conversation
     <message>: Say something in the current conversation
   From anywhere:
     exit: exit the program (and leave the current conversation)
+    logout: end the session and forget the session token
+    revoke <users>: (admins only) revoke all session tokens of comma-separated users
+    password <user> <password>: (admins only) set a user's password
+    times relative|absolute: show message times as ages or as clock times
     help: Show this help screen
 `
 	if clearView {
-		c.print(content)
+		c.print("%s", content)
 	} else {
-		c.updateContent(content)
+		c.updateContent("%s", content)
 	}
 }
 
@@ -690,26 +2554,87 @@ func (c *ConnTapClient) print(format string, a ...interface{}) {
 		content += "\n"
 	}
 
-	header := "Inbox"
-	if c.conversation != nil {
-		header = c.conversation.Title
-	}
 	divider := "\n================================\n"
 	prompt := c.user + "$ "
 
-	fmt.Print("\033[2J\033[1;1H" + header + divider + content + "\n" + prompt)
+	fmt.Print("\033[2J\033[1;1H" + c.header() + divider + content + "\n" + prompt)
 }
 
 func (c *ConnTapClient) updateContent(format string, a ...interface{}) {
 	content := fmt.Sprintf(format, a...)
 
-	header := "Inbox"
-	if c.conversation != nil {
-		header = c.conversation.Title
-	}
 	divider := "\n================================\n"
 
 	fmt.Print("\033[s\033[1;1H" +
 		strings.Repeat("\033[K\033[1B", 22) +
-		"\033[1;1H" + header + divider + content + "\033[u")
+		"\033[1;1H" + c.header() + divider + content + "\033[u")
+}
+
+// parseTimes reads a -times setting and reports whether it is absolute
+func parseTimes(times string) (bool, error) {
+	switch strings.TrimSpace(times) {
+	case "relative":
+		return false, nil
+	case "absolute":
+		return true, nil
+	}
+	return false, errors.New("Times must be relative or absolute")
+}
+
+func (c *ConnTapClient) formatTime(t time.Time) string {
+	if c.absoluteTimes {
+		return absoluteTime(t, time.Now())
+	}
+	return relativeTime(t, time.Now())
+}
+
+// relativeTime says how long before now t was, roughly
+func relativeTime(t, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	age := now.Sub(t)
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", age/time.Minute)
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", age/time.Hour)
+	}
+	return fmt.Sprintf("%dd ago", age/(24*time.Hour))
+}
+
+// absoluteTime gives the local time of t, and its date unless it was today
+func absoluteTime(t, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	t, now = t.Local(), now.Local()
+	if t.YearDay() == now.YearDay() && t.Year() == now.Year() {
+		return t.Format("15:04")
+	}
+	if t.Year() == now.Year() {
+		return t.Format("Jan 2 15:04")
+	}
+	return t.Format("Jan 2 2006 15:04")
+}
+
+// header names the current view and shows the last error, if any. It must
+// be called with the lock held, since conversations can be renamed.
+func (c *ConnTapClient) header() string {
+	header := "Inbox"
+	if c.conversation != nil {
+		header = c.conversation.Title
+		if c.thread != 0 {
+			header += fmt.Sprintf(" > thread #%d", c.thread)
+		}
+	}
+	if c.status != "" {
+		header += "  (" + c.status + ")"
+	}
+	if c.err != "" {
+		header += "  [Error: " + c.err + "]"
+	}
+	return header
 }
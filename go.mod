@@ -0,0 +1,3 @@
+module github.com/seanpont/tcptap
+
+go 1.24
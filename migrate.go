@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+)
+
+// ===== MIGRATION ===========================================================
+
+// Taps used to refer to conversations by title. A FileStore that opens a log
+// or snapshot from back then migrates it: every conversation gets the id of
+// the tap that created it, every tap that named it by title is rewritten to
+// use that id, and the log is rewritten and the old snapshots removed so
+// that the migration only ever happens once.
+
+// isLegacyTap reports whether tap was stored before conversations had ids.
+// Nothing else can tell: old taps only ever named a conversation after the
+// tap that created it.
+func isLegacyTap(tap *Tap) bool {
+	return tap.Type == TYPE_CONVERSATION && tap.Title == ""
+}
+
+func isLegacyHistory(taps []*Tap) bool {
+	for _, tap := range taps {
+		if isLegacyTap(tap) {
+			return true
+		}
+	}
+	return false
+}
+
+// A titleMigrator rewrites legacy taps in order, remembering the id each
+// title was given. Titles were unique back then.
+type titleMigrator map[string]string
+
+func (m titleMigrator) migrate(tap *Tap) {
+	if tap.Type == TYPE_CONVERSATION {
+		if tap.Title == "" {
+			tap.Title = tap.Conversation
+		}
+		tap.Conversation = conversationId(tap.Id)
+		m[tap.Title] = tap.Conversation
+		return
+	}
+	if id, ok := m[tap.Conversation]; ok {
+		tap.Conversation = id
+	}
+}
+
+// finishMigration rewrites the log with the migrated taps, then removes the
+// legacy snapshots.
+func (f *FileStore) finishMigration() error {
+	err := f.rewriteLog()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %d taps to conversation ids\n", len(f.data.Taps))
+	return nil
+}
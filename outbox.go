@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+)
+
+// ===== OUTBOX ==============================================================
+
+// An Outbox holds the taps a client has sent that the server has not yet
+// acknowledged, in the order they were sent. When it has a path it is saved
+// there after every change, so that nothing typed while offline is lost if
+// the client exits before it reconnects.
+//
+// An Outbox is not safe for concurrent use; the client guards it with its
+// lock.
+type Outbox struct {
+	path string
+	taps []*Tap
+}
+
+// NewOutbox returns an in-memory outbox.
+func NewOutbox() *Outbox {
+	return &Outbox{taps: make([]*Tap, 0)}
+}
+
+// OpenOutbox loads the outbox saved at path, if any.
+func OpenOutbox(path string) (*Outbox, error) {
+	o := NewOutbox()
+	o.path = path
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &o.taps)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Add queues a tap, which must carry a request id.
+func (o *Outbox) Add(tap *Tap) error {
+	o.taps = append(o.taps, tap)
+	return o.save()
+}
+
+// Remove drops the tap with the given request id and reports whether there
+// was one.
+func (o *Outbox) Remove(request string) (bool, error) {
+	for i, tap := range o.taps {
+		if tap.Request == request {
+			o.taps = append(o.taps[:i], o.taps[i+1:]...)
+			return true, o.save()
+		}
+	}
+	return false, nil
+}
+
+// Taps returns the queued taps, oldest first.
+func (o *Outbox) Taps() []*Tap {
+	taps := make([]*Tap, len(o.taps))
+	copy(taps, o.taps)
+	return taps
+}
+
+func (o *Outbox) Len() int {
+	return len(o.taps)
+}
+
+func (o *Outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+	b, err := json.Marshal(o.taps)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.path, b)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ===== SNAPSHOTS ===========================================================
+
+// A snapshot is the server's Data as of a given tap: the taps so far, which
+// catching clients up needs, and the state they build up, so that startup
+// only has to apply the taps since. Once a snapshot is written the tap log
+// only needs the taps after it. Snapshots are named after the last tap they
+// cover and carry a checksum so that a torn or corrupt snapshot can be
+// detected and skipped in favour of an older one.
+
+const (
+	SNAPSHOT_PREFIX = "snapshot-"
+	SNAPSHOT_SUFFIX = ".json"
+	SNAPSHOTS_KEPT  = 2
+)
+
+// snapshotOf copies data so that it can be written out while more taps are
+// applied. Taps are never modified once applied, so they are shared.
+func snapshotOf(data *Data) *Data {
+	copied := &Data{
+		Taps:          data.Taps[:len(data.Taps):len(data.Taps)],
+		Users:         make(map[string]int, len(data.Users)),
+		Conversations: make(map[string]*Conversation, len(data.Conversations)),
+	}
+	for user, tapId := range data.Users {
+		copied.Users[user] = tapId
+	}
+	for id, c := range data.Conversations {
+		copied.Conversations[id] = c.Copy()
+	}
+	return copied
+}
+
+type snapshot struct {
+	LastTapId int             `json:"lastTapId"`
+	Checksum  uint32          `json:"checksum"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func snapshotPath(dir string, lastTapId int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%012d%s", SNAPSHOT_PREFIX, lastTapId, SNAPSHOT_SUFFIX))
+}
+
+// snapshotIds returns the ids of the snapshots in dir, newest first.
+func snapshotIds(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, SNAPSHOT_PREFIX) || !strings.HasSuffix(name, SNAPSHOT_SUFFIX) {
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, SNAPSHOT_PREFIX), SNAPSHOT_SUFFIX))
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	return ids, nil
+}
+
+// WriteSnapshot atomically writes data, which must end with the tap
+// lastTapId, to dir.
+func WriteSnapshot(dir string, lastTapId int, data *Data) error {
+	if lastTapId < 0 {
+		return errors.New("Nothing to snapshot")
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&snapshot{
+		LastTapId: lastTapId,
+		Checksum:  crc32.ChecksumIEEE(raw),
+		Data:      raw,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(snapshotPath(dir, lastTapId), b)
+}
+
+// LoadSnapshot returns the newest valid snapshot in dir and the id of the
+// last tap it covers, or nil if there is none.
+func LoadSnapshot(dir string) (*Data, int, error) {
+	ids, err := snapshotIds(dir)
+	if err != nil {
+		return nil, -1, err
+	}
+	for _, id := range ids {
+		path := snapshotPath(dir, id)
+		data, err := readSnapshot(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping snapshot %s: %s\n", path, err)
+			continue
+		}
+		if len(data.Taps) != id+1 {
+			fmt.Fprintf(os.Stderr, "Skipping snapshot %s: has %d taps\n", path, len(data.Taps))
+			continue
+		}
+		return data, id, nil
+	}
+	return nil, -1, nil
+}
+
+func readSnapshot(path string) (*Data, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snap := new(snapshot)
+	err = json.Unmarshal(b, snap)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(snap.Data) != snap.Checksum {
+		return nil, errors.New("Checksum mismatch")
+	}
+	data := NewData()
+	err = json.Unmarshal(snap.Data, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// PruneSnapshots deletes all but the newest SNAPSHOTS_KEPT snapshots, so
+// that there is an older one to fall back on if the newest turns out to be
+// corrupt. It returns the ids of those kept, newest first.
+func PruneSnapshots(dir string) ([]int, error) {
+	ids, err := snapshotIds(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) <= SNAPSHOTS_KEPT {
+		return ids, nil
+	}
+	for _, id := range ids[SNAPSHOTS_KEPT:] {
+		err = os.Remove(snapshotPath(dir, id))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ids[:SNAPSHOTS_KEPT], nil
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ===== STORAGE =============================================================
+
+// A TapStore holds every tap accepted by the server along with the Data
+// those taps build up. The server only talks to its store, so backends can
+// be swapped without touching the protocol.
+//
+// Stores are safe for concurrent use: one goroutine appends while every
+// session reads. Taps are never modified once appended, so the taps a store
+// hands out may be shared; anything else it returns is a copy.
+type TapStore interface {
+	// Append assigns the tap the next id and applies it. Taps that Data
+	// rejects are not stored.
+	Append(tap *Tap) error
+	// Len is the number of stored taps, which is also the next tap id.
+	Len() int
+	// Range returns the taps with from <= id < to.
+	Range(from, to int) []*Tap
+	// UserTaps returns the taps relevant to user with id >= from, along with
+	// the cursor to continue from next time.
+	UserTaps(user string, from int) (taps []*Tap, next int)
+	// ConversationTaps returns the taps of a conversation with id < before,
+	// saying its messages as they stand now: deleted ones without their
+	// body and edited ones with their latest.
+	ConversationTaps(conversation string, before int) []*Tap
+	// Request returns the id of the tap user sent with the given request id,
+	// if it is among their last REQUESTS_KEPT requests.
+	Request(user, request string) (tapId int, ok bool)
+	// Conversation returns a copy of the conversation with the given id, or
+	// nil.
+	Conversation(id string) *Conversation
+	// Membership returns the id of the tap that added user to the
+	// conversation, or 0 if user is not a member.
+	Membership(conversation, user string) int
+	Users() []string
+	// LoggedIn reports whether user has ever logged in, as opposed to only
+	// having been invited.
+	LoggedIn(user string) bool
+	Close() error
+}
+
+// A Snapshotter is a TapStore that can checkpoint itself. Snapshot may run
+// alongside Append.
+type Snapshotter interface {
+	Snapshot() error
+}
+
+// ===== MEMORY STORE ========================================================
+
+// REQUESTS_KEPT is how many of each user's requests are remembered to spot
+// retries. Clients only retry taps that are still waiting for an ack, so it
+// only needs to cover that many.
+const REQUESTS_KEPT = 1024
+
+// recentRequests holds the tap ids of a user's last REQUESTS_KEPT requests.
+type recentRequests struct {
+	tapIds map[string]int
+	order  []string // oldest first
+}
+
+func (r *recentRequests) add(request string, tapId int) {
+	r.tapIds[request] = tapId
+	r.order = append(r.order, request)
+	if len(r.order) > REQUESTS_KEPT {
+		delete(r.tapIds, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+// A MemStore keeps everything in memory. Besides Data it indexes tap ids by
+// conversation and by user, so that catching a user up costs as much as the
+// taps they actually receive rather than every tap ever.
+type MemStore struct {
+	data             *Data
+	authTaps         []int                      // relevant to everyone
+	userTaps         map[string][]int           // relevant to each user, auth taps aside
+	conversationTaps map[string][]int           // by conversation id
+	requests         map[string]*recentRequests // by user
+	loggedIn         map[string]bool            // users with an auth tap
+	lock             sync.RWMutex
+}
+
+func NewMemStore() *MemStore {
+	return newMemStore(NewData())
+}
+
+// newMemStore indexes taps already applied to data. Memberships are replayed
+// along the way, so that a user who has since left still gets the taps from
+// while they were in a conversation.
+func newMemStore(data *Data) *MemStore {
+	m := &MemStore{
+		data:             data,
+		authTaps:         make([]int, 0),
+		userTaps:         make(map[string][]int),
+		conversationTaps: make(map[string][]int),
+		requests:         make(map[string]*recentRequests),
+		loggedIn:         make(map[string]bool),
+	}
+	members := make(map[string]map[string]int) // by conversation id
+	for _, tap := range data.Taps {
+		switch tap.Type {
+		case TYPE_CONVERSATION:
+			members[tap.Conversation] = map[string]int{tap.User: tap.Id}
+			fallthrough
+		case TYPE_INVITE:
+			for _, user := range tap.Args {
+				members[tap.Conversation][user] = tap.Id
+			}
+		case TYPE_LEAVE:
+			delete(members[tap.Conversation], tap.User)
+		}
+		m.indexAs(tap, members[tap.Conversation])
+	}
+	return m
+}
+
+func (m *MemStore) Append(tap *Tap) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tap.Id = len(m.data.Taps)
+	err := m.data.Check(tap)
+	if err != nil {
+		return err
+	}
+	m.apply(tap)
+	return nil
+}
+
+// apply must be called with the write lock held, and only with taps that
+// have passed Check
+func (m *MemStore) apply(tap *Tap) {
+	m.data.Apply(tap)
+	m.data.Taps = append(m.data.Taps, tap)
+	m.index(tap)
+}
+
+// index must be called with the write lock held
+func (m *MemStore) index(tap *Tap) {
+	var members map[string]int
+	c := m.data.Conversations[tap.Conversation]
+	if c != nil {
+		members = c.Users
+	}
+	m.indexAs(tap, members)
+}
+
+// indexAs indexes tap given who is in its conversation once it is applied,
+// which is nil if it isn't about one.
+func (m *MemStore) indexAs(tap *Tap, members map[string]int) {
+	if tap.Request != "" {
+		requests := m.requests[tap.User]
+		if requests == nil {
+			requests = &recentRequests{tapIds: make(map[string]int)}
+			m.requests[tap.User] = requests
+		}
+		requests.add(tap.Request, tap.Id)
+	}
+	if tap.Type == TYPE_AUTH {
+		m.authTaps = append(m.authTaps, tap.Id)
+		m.loggedIn[tap.User] = true
+		return
+	}
+	if members == nil {
+		return
+	}
+	m.conversationTaps[tap.Conversation] = append(m.conversationTaps[tap.Conversation], tap.Id)
+	for user, membershipId := range members {
+		if isRelevant(user, tap, membershipId) {
+			m.userTaps[user] = append(m.userTaps[user], tap.Id)
+		}
+	}
+	if _, ok := members[tap.User]; !ok && isRelevant(tap.User, tap, 0) {
+		m.userTaps[tap.User] = append(m.userTaps[tap.User], tap.Id)
+	}
+}
+
+func (m *MemStore) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.data.Taps)
+}
+
+func (m *MemStore) Range(from, to int) []*Tap {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if to > len(m.data.Taps) {
+		to = len(m.data.Taps)
+	}
+	if from >= to {
+		return nil
+	}
+	return m.data.Taps[from:to]
+}
+
+func (m *MemStore) UserTaps(user string, from int) ([]*Tap, int) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	auths := m.authTaps[sort.SearchInts(m.authTaps, from):]
+	own := m.userTaps[user]
+	own = own[sort.SearchInts(own, from):]
+
+	// merge the two
+	taps := make([]*Tap, 0, len(auths)+len(own))
+	for len(auths) > 0 || len(own) > 0 {
+		if len(own) == 0 || (len(auths) > 0 && auths[0] < own[0]) {
+			taps = append(taps, m.data.Taps[auths[0]])
+			auths = auths[1:]
+		} else {
+			taps = append(taps, m.data.Taps[own[0]])
+			own = own[1:]
+		}
+	}
+	return taps, len(m.data.Taps)
+}
+
+func (m *MemStore) ConversationTaps(conversation string, before int) []*Tap {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ids := m.conversationTaps[conversation]
+	ids = ids[:sort.SearchInts(ids, before)]
+	c := m.data.Conversations[conversation]
+	taps := make([]*Tap, len(ids))
+	for i, id := range ids {
+		taps[i] = redact(m.data.Taps[id], c)
+	}
+	return taps
+}
+
+// REDACTED stands in for the body of a deleted message when it is replayed.
+const REDACTED = "(deleted)"
+
+// redact returns tap as it should be replayed, given how the message it says
+// or edits stands now. Stored taps are shared, so it returns a copy if it
+// changes anything.
+func redact(tap *Tap, c *Conversation) *Tap {
+	var m *Message
+	switch tap.Type {
+	case TYPE_MESSAGE:
+		m = c.Message(tap.Id)
+	case TYPE_EDIT:
+		if len(tap.Args) > 0 {
+			tapId, err := strconv.Atoi(tap.Args[0])
+			if err == nil {
+				m = c.Message(tapId)
+			}
+		}
+	}
+	if m == nil || !(m.Deleted || m.Edited) {
+		return tap
+	}
+	redacted := *tap
+	if m.Deleted {
+		redacted.Value = REDACTED
+	} else {
+		redacted.Value = m.Body
+	}
+	return &redacted
+}
+
+func (m *MemStore) Request(user, request string) (int, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	requests := m.requests[user]
+	if requests == nil {
+		return 0, false
+	}
+	tapId, ok := requests.tapIds[request]
+	return tapId, ok
+}
+
+func (m *MemStore) Conversation(id string) *Conversation {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	c := m.data.Conversations[id]
+	if c == nil {
+		return nil
+	}
+	return c.Copy()
+}
+
+func (m *MemStore) Membership(conversation, user string) int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	c := m.data.Conversations[conversation]
+	if c == nil {
+		return 0
+	}
+	return c.Users[user]
+}
+
+func (m *MemStore) Users() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	users := make([]string, 0, len(m.data.Users))
+	for user, _ := range m.data.Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+func (m *MemStore) LoggedIn(user string) bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.loggedIn[user]
+}
+
+func (m *MemStore) Close() error {
+	return nil
+}
+
+// ===== FILE STORE ==========================================================
+
+// ErrNotStored is what the sender of a tap hears if it couldn't be written.
+var ErrNotStored = errors.New("Could not store tap, try again")
+
+// A FileStore is a MemStore backed by a directory holding an append-only tap
+// log and periodic snapshots. A snapshot holds the taps it covers, so the
+// log only keeps the taps the oldest snapshot doesn't. Opening it rebuilds
+// the data from the newest valid snapshot plus the taps the log has beyond
+// it.
+type FileStore struct {
+	*MemStore
+	dir          string
+	log          *TapLog
+	snapshotId   int
+	snapshotLock sync.Mutex // held while writing a snapshot
+}
+
+func OpenFileStore(dir string, policy SyncPolicy, syncInterval time.Duration) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f := &FileStore{
+		MemStore:   NewMemStore(),
+		dir:        dir,
+		snapshotId: -1,
+	}
+	data, snapshotId, err := LoadSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "taps.log")
+	f.log, err = OpenTapLog(path, policy, syncInterval)
+	if err != nil {
+		return nil, err
+	}
+	err = f.load(data, snapshotId)
+	if err != nil {
+		f.log.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// load rebuilds the data from the snapshot, if there is one, and the log.
+func (f *FileStore) load(data *Data, snapshotId int) error {
+	taps := make([]*Tap, 0)
+	if data != nil {
+		taps = append(taps, data.Taps...)
+	}
+	err := f.log.Replay(func(tap *Tap) error {
+		if tap.Id < len(taps) {
+			return nil // in the snapshot too
+		}
+		if len(taps) == 0 && tap.Id > 0 {
+			return fmt.Errorf("Tap log starts at tap %d and no snapshot has the taps before it",
+				tap.Id)
+		}
+		if tap.Id != len(taps) {
+			return fmt.Errorf("Tap log out of order: expected tap %d, found %d",
+				len(taps), tap.Id)
+		}
+		taps = append(taps, tap)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	legacy := isLegacyHistory(taps)
+	applied := taps
+	if legacy {
+		// Rebuild everything from the migrated taps
+		migrator := make(titleMigrator)
+		for _, tap := range taps {
+			migrator.migrate(tap)
+		}
+	} else if data != nil {
+		data.Taps = taps[:snapshotId+1]
+		f.MemStore = newMemStore(data)
+		f.snapshotId = snapshotId
+		applied = taps[snapshotId+1:]
+		fmt.Printf("Loaded snapshot at tap %d\n", snapshotId)
+	}
+	for _, tap := range applied {
+		err = f.MemStore.Append(tap)
+		if err != nil {
+			return fmt.Errorf("Replaying tap %d: %s", tap.Id, err)
+		}
+	}
+	fmt.Printf("Replayed %d taps from %s\n", len(applied), f.log.path)
+
+	if legacy {
+		return f.finishMigration()
+	}
+	return nil
+}
+
+// rewriteLog writes every tap to the log afresh and removes the snapshots,
+// which may hold taps in a form that has since changed. A snapshot is written
+// as usual at the next interval.
+func (f *FileStore) rewriteLog() error {
+	err := f.log.Rewrite(f.data.Taps)
+	if err != nil {
+		return err
+	}
+	ids, err := snapshotIds(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = os.Remove(snapshotPath(f.dir, id))
+		if err != nil {
+			return err
+		}
+	}
+	f.snapshotId = -1
+	return nil
+}
+
+// Append checks the tap and writes it to the log before applying it, so
+// that nothing is acknowledged that a restart would lose and nothing is
+// logged that Data rejects.
+func (f *FileStore) Append(tap *Tap) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	tap.Id = len(f.data.Taps)
+	err := f.data.Check(tap)
+	if err != nil {
+		return err
+	}
+	err = f.log.Append(tap)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing tap log:", err)
+		return ErrNotStored
+	}
+	f.apply(tap)
+	return nil
+}
+
+// Snapshot writes the data to disk, then compacts the log down to the taps
+// the oldest snapshot kept doesn't have. Appends only wait while the data is
+// copied, not while it is encoded and written.
+func (f *FileStore) Snapshot() error {
+	f.snapshotLock.Lock()
+	defer f.snapshotLock.Unlock()
+	f.lock.RLock()
+	lastTapId := len(f.data.Taps) - 1
+	if lastTapId == f.snapshotId {
+		f.lock.RUnlock()
+		return nil
+	}
+	data := snapshotOf(f.data)
+	f.lock.RUnlock()
+
+	// Make sure the log has everything the snapshot covers, so that falling
+	// back to an older snapshot never finds a gap in it
+	err := f.log.Sync()
+	if err != nil {
+		return err
+	}
+	err = WriteSnapshot(f.dir, lastTapId, data)
+	if err != nil {
+		return err
+	}
+	f.snapshotId = lastTapId
+	fmt.Printf("Wrote snapshot at tap %d\n", f.snapshotId)
+	kept, err := PruneSnapshots(f.dir)
+	if err != nil {
+		return err
+	}
+	if len(kept) < SNAPSHOTS_KEPT {
+		return nil // nothing to fall back on yet, so the log keeps every tap
+	}
+	return f.log.Compact(kept[len(kept)-1])
+}
+
+func (f *FileStore) Close() error {
+	f.snapshotLock.Lock()
+	defer f.snapshotLock.Unlock()
+	return f.log.Close()
+}
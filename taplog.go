@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ===== TAP LOG =============================================================
+
+// The tap log is an append-only file with one JSON encoded tap per line.
+// Replaying it through Data.Update on top of the newest snapshot rebuilds the
+// server's state.
+
+type SyncPolicy int
+
+const (
+	// Sync policies
+	SYNC_ALWAYS   SyncPolicy = iota // fsync after every tap
+	SYNC_INTERVAL                   // fsync periodically
+	SYNC_NEVER                      // leave it to the OS
+)
+
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch policy {
+	case "always":
+		return SYNC_ALWAYS, nil
+	case "interval":
+		return SYNC_INTERVAL, nil
+	case "never":
+		return SYNC_NEVER, nil
+	}
+	return SYNC_ALWAYS, errors.New("Unknown sync policy '" + policy + "'")
+}
+
+type TapLog struct {
+	path   string
+	file   *os.File
+	policy SyncPolicy
+	dirty  bool
+	done   chan bool
+	lock   sync.Mutex
+}
+
+func OpenTapLog(path string, policy SyncPolicy, interval time.Duration) (*TapLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &TapLog{
+		path:   path,
+		file:   file,
+		policy: policy,
+		done:   make(chan bool),
+	}
+	if policy == SYNC_INTERVAL {
+		if interval <= 0 {
+			interval = time.Second
+		}
+		go l.syncEvery(interval)
+	}
+	return l, nil
+}
+
+// Replay calls fn with every tap in the log, in order. A partially written
+// final line (from a crash mid-append) is truncated away.
+func (l *TapLog) Replay(fn func(tap *Tap) error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, err := l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(l.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Fprintf(os.Stderr, "Truncating partial tap at offset %d\n", offset)
+				err = l.file.Truncate(offset)
+				if err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		tap := new(Tap)
+		err = json.Unmarshal(line, tap)
+		if err != nil {
+			return fmt.Errorf("Corrupt tap at offset %d: %s", offset, err)
+		}
+		err = fn(tap)
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+	_, err = l.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Append writes tap to the end of the log. If it can't be written whole,
+// whatever part of it was written is cut off again, so that a failed append
+// never leaves a broken line for Replay to trip over.
+func (l *TapLog) Append(tap *Tap) error {
+	b, err := json.Marshal(tap)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(b)
+	if err == nil && l.policy == SYNC_ALWAYS {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.cut(offset)
+		return err
+	}
+	l.dirty = true
+	return nil
+}
+
+// cut truncates the log at offset. It must be called with the lock held.
+func (l *TapLog) cut(offset int64) error {
+	err := l.file.Truncate(offset)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error truncating tap log:", err)
+		return err
+	}
+	_, err = l.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Compact drops every tap up to and including lastTapId from the front of the
+// log. Those taps must already be covered by a snapshot.
+func (l *TapLog) Compact(lastTapId int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, err := l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.Create(l.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	reader := bufio.NewReader(l.file)
+	writer := bufio.NewWriter(tmp)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var header struct {
+			Id int `json:"id"`
+		}
+		err = json.Unmarshal(line, &header)
+		if err != nil {
+			return err
+		}
+		if header.Id > lastTapId {
+			writer.Write(line)
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return l.replaceWith(tmp)
+}
+
+// Rewrite replaces the whole log with taps.
+func (l *TapLog) Rewrite(taps []*Tap) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	tmp, err := os.Create(l.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	for _, tap := range taps {
+		b, err := json.Marshal(tap)
+		if err != nil {
+			return err
+		}
+		writer.Write(b)
+		writer.WriteByte('\n')
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	return l.replaceWith(tmp)
+}
+
+// replaceWith moves tmp over the log. It must be called with the lock held.
+func (l *TapLog) replaceWith(tmp *os.File) error {
+	err := tmp.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), l.path)
+	if err != nil {
+		return err
+	}
+
+	// Swap in the new file for subsequent appends
+	l.file.Close()
+	l.file, err = os.OpenFile(l.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Seek(0, io.SeekEnd)
+	return err
+}
+
+func (l *TapLog) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.dirty {
+		return nil
+	}
+	l.dirty = false
+	return l.file.Sync()
+}
+
+func (l *TapLog) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := l.Sync()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error syncing tap log:", err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *TapLog) Close() error {
+	close(l.done)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.file.Sync()
+	if err != nil {
+		return err
+	}
+	return l.file.Close()
+}
@@ -9,5 +9,6 @@ func main() {
 	commander.NewCommandMap(
 		simpleTapServer,
 		connTapServer,
-		connTapClient).Run(os.Args)
+		connTapClient,
+		setPassword).Run(os.Args)
 }
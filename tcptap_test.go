@@ -1,67 +1,162 @@
 package main
 
 import (
-	_ "fmt"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"github.com/seanpont/assert"
+	"github.com/seanpont/gobro/strarr"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+func openFileStore(t *testing.T, dir string) *FileStore {
+	store, err := OpenFileStore(dir, SYNC_NEVER, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func newServer(store TapStore) *ConnTapServer {
+	return NewConnTapServer(store, ServerConfig{
+		Credentials: NewCredentials(1),
+		Admins:      []string{"admin"},
+	})
+}
+
+// connect registers user and logs them in. Admins can't register, so they
+// get their password as setPassword would give it.
 func connect(server *ConnTapServer, user string) (client *ConnTapClient) {
-	client = NewConnTapClient(user)
-	clientToServer := make(chan *Tap, 3)
-	serverToClient := make(chan *Tap, 3)
-	go client.sync(serverToClient, clientToServer)
-	go server.handle(clientToServer, serverToClient)
+	client = NewConnTapClient(user, "password")
+	if strarr.Contains(server.config.Admins, user) {
+		server.credentials.SetPassword(user, "password")
+	} else {
+		client.register = true
+	}
+	return login(server, client)
+}
+
+func login(server *ConnTapServer, client *ConnTapClient) *ConnTapClient {
+	clientToServer := make(chan *Tap, 100)
+	serverToClient := make(chan *Tap, 100)
+	received := make(chan *Tap, 100)
+	// so that sync can take what the test sends while the test is not draining
+	client.syncToUser = make(chan *Tap, 100)
+	go func() {
+		client.sync(received, clientToServer)
+		close(client.syncToUser)
+	}()
+	go server.handle(clientToServer, serverToClient, "")
+
+	// Over a real connection the client decodes its own copy of each tap
+	go func() {
+		defer close(received)
+		for tap := range serverToClient {
+			copied := *tap
+			received <- &copied
+		}
+	}()
 	return client
 }
 
+// DRAIN_TIMEOUT is how long to wait for taps that are expected. drain's
+// short window is only for checking that nothing more arrives.
+const DRAIN_TIMEOUT = 5 * time.Second
+
 func drain(count int, client *ConnTapClient) bool {
+	return drainWithin(time.Millisecond*10, count, client)
+}
+
+func drainWithin(timeout time.Duration, count int, client *ConnTapClient) bool {
 	for count > 0 {
 		select {
 		case <-client.syncToUser:
 			count--
-		case <-time.After(time.Millisecond * 10):
+		case <-time.After(timeout):
 			return false
 		}
 	}
 	return true
 }
 
+// connectAll connects each user in turn and waits until every client has
+// heard of every user
+func connectAll(t *testing.T, server *ConnTapServer, users ...string) []*ConnTapClient {
+	clients := make([]*ConnTapClient, len(users))
+	for i, user := range users {
+		clients[i] = connect(server, user)
+	}
+	for i, client := range clients {
+		if !drainWithin(DRAIN_TIMEOUT, len(users), client) {
+			t.Fatalf("%s did not hear every auth", users[i])
+		}
+	}
+	return clients
+}
+
+// titled returns the conversation in data with the given title
+func titled(data *Data, title string) *Conversation {
+	for _, conversation := range data.Conversations {
+		if conversation.Title == title {
+			return conversation
+		}
+	}
+	return nil
+}
+
 func TestReplayConversation(t *testing.T) {
 	assert := assert.Assert(t)
-	server := NewConnTapServer()
+	server := newServer(NewMemStore())
 
 	sean := connect(server, "sean")
 	alex := connect(server, "alex")
-	sean.userToSync <- NewTap(TYPE_CONVERSATION, "sean", "title", "")
-	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", "title", "message1")
-	assert.True(drain(4, sean), "")
-	assert.True(drain(2, alex), "")
-	sean.userToSync <- NewTap(TYPE_INVITE, "sean", "title", "", "alex")
-	assert.True(drain(1, sean), "")
-	assert.True(drain(3, alex), "")
+	sean.userToSync <- NewConversationTap("sean", "title")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, sean), "")
+	id := titled(sean.data, "title").Id
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", id, "message1")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, alex), "")
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", id, "", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, alex), "")
 
-	assert.NotNil(sean.data.Conversations["title"])
-	assert.NotNil(alex.data.Conversations["title"])
+	assert.NotNil(sean.data.Conversations[id])
+	assert.NotNil(alex.data.Conversations[id])
 }
 
 func TestIsRelevant(t *testing.T) {
 	assert := assert.Assert(t)
-	server := NewConnTapServer()
+	server := newServer(NewMemStore())
 
 	sean := connect(server, "sean")
 	alex := connect(server, "alex")
 
 	// both clients receive each other's auths
-	assert.True(drain(2, sean), "")
-	assert.True(drain(2, alex), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, alex), "")
 
 	// sean creates a conversation that includes John but not alex
-	sean.userToSync <- NewTap(TYPE_CONVERSATION, "sean", "apples", "tasty", "john")
-	assert.True(drain(1, sean), "")
-	assert.Equal(len(sean.data.Conversations["apples"].Users), 2)
-	assert.False(server.data.Conversations["apples"].Users["alex"] > 0, "")
+	sean.userToSync <- NewConversationTap("sean", "apples", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	apples := titled(sean.data, "apples").Id
+	assert.Equal(len(sean.data.Conversations[apples].Users), 2)
+	assert.False(server.store.Membership(apples, "alex") > 0, "")
 
 	// alex does not get the conversation
 	assert.False(drain(1, alex), "")
@@ -69,38 +164,38 @@ func TestIsRelevant(t *testing.T) {
 
 	// but john will
 	john := connect(server, "john")
-	assert.True(drain(4, john), "") // two auths, conversation, auth
-	assert.True(drain(1, sean), "") // john's auth
-	assert.True(drain(1, alex), "") // john's auth
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, john), "") // two auths, conversation, auth
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "") // john's auth
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "") // john's auth
 
 	// John is now all caught up
-	assert.NotNil(john.data.Conversations["apples"])
+	assert.NotNil(john.data.Conversations[apples])
 
 	// john and sean chat about apples
-	john.userToSync <- NewTap(TYPE_MESSAGE, "john", "apples", "hi")
-	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", "apples", "hello")
-	assert.True(drain(2, sean), "")
-	assert.True(drain(2, john), "")
+	john.userToSync <- NewTap(TYPE_MESSAGE, "john", apples, "hi")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", apples, "hello")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, john), "")
 	assert.False(drain(2, alex), "") // alex doesn't get anything
 
 	// Both users should have 3 messages (initial, john's, and sean's)
-	assert.Equal(len(john.data.Conversations["apples"].Messages), 3)
-	assert.Equal(len(sean.data.Conversations["apples"].Messages), 3)
+	assert.Equal(len(john.data.Conversations[apples].Messages), 3)
+	assert.Equal(len(sean.data.Conversations[apples].Messages), 3)
 
 	// Now john invites alex
-	john.userToSync <- NewTap(TYPE_INVITE, "john", "apples", "", "alex")
+	john.userToSync <- NewTap(TYPE_INVITE, "john", apples, "", "alex")
 	// alex should now receive all taps about conversation, in order, including his own invite
-	assert.True(drain(4, alex), "") // conversation, hi, hello, invite
-	assert.True(drain(1, sean), "") // invite
-	assert.True(drain(1, john), "") // invite
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, alex), "") // conversation, hi, hello, invite
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "") // invite
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, john), "") // invite
 
 	// and now alex is all caught up
-	assert.NotNil(alex.data.Conversations["apples"])
+	assert.NotNil(alex.data.Conversations[apples])
 }
 
 func TestConnTap(t *testing.T) {
 	assert := assert.Assert(t)
-	server := NewConnTapServer()
+	server := newServer(NewMemStore())
 
 	sean := connect(server, "sean")
 
@@ -109,32 +204,1540 @@ func TestConnTap(t *testing.T) {
 	assert.NotNil(authTap)
 	// And users should have been created on client and server
 	assert.Equal(len(sean.data.Users), 1)
-	assert.Equal(len(server.data.Users), 1)
+	assert.Equal(len(server.store.Users()), 1)
 
 	//Create a conversation
-	sean.userToSync <- NewTap(TYPE_CONVERSATION, "sean", "bananas", "Hey guys", "alex", "will")
+	bananas := NewConversationTap("sean", "bananas", "alex", "will")
+	bananas.Value = "Hey guys"
+	sean.userToSync <- bananas
 	conversationTap := <-sean.syncToUser
 	assert.NotNil(conversationTap)
+	assert.Equal(conversationTap.Conversation, conversationId(conversationTap.Id))
+	assert.Equal(conversationTap.Title, "bananas")
 
 	// Client and server should both have conversation with 3 participants and 1 message
 	assert.Equal(len(sean.data.Conversations), 1)
-	conversation := sean.data.Conversations["bananas"]
+	conversation := sean.data.Conversations[conversationTap.Conversation]
 	assert.Equal(len(conversation.Users), 3) // sean, alex, will
 	assert.Equal(len(sean.data.Users), 3)
 	assert.Equal(len(conversation.Messages), 1)
 	assert.Equal(conversation.Messages[0].Body, "Hey guys")
 
-	assert.Equal(len(server.data.Conversations), 1)
-	conversation = server.data.Conversations["bananas"]
+	assert.Equal(server.store.Len(), 2)
+	conversation = server.store.Conversation(conversationTap.Conversation)
 	assert.Equal(len(conversation.Users), 3) // sean, alex, will
 	assert.Equal(len(conversation.Messages), 1)
 
 	// Alex joins the party
 	alex := connect(server, "alex")
-	drain(3, alex) // sean auth, cconversation, alex auth
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, alex), "") // sean auth, conversation, alex auth
 	assert.Equal(len(alex.data.Conversations), 1)
-	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", "bananas", "Hey Sean")
-	drain(1, alex) // message
-	drain(2, sean) // alex auth, message
-	assert.Equal(sean.data.Conversations["bananas"].Messages[1].Body, "Hey Sean")
+	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", conversation.Id, "Hey Sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "") // message
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "") // alex auth, message
+	assert.Equal(sean.data.Conversations[conversation.Id].Messages[1].Body, "Hey Sean")
+}
+
+func TestTapLogReplay(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+	store := openFileStore(t, dir)
+	server := newServer(store)
+
+	// Every tap is written to disk on the way, so allow for that
+	sean := connect(server, "sean")
+	sean.userToSync <- NewConversationTap("sean", "cherries", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	cherries := titled(sean.data, "cherries").Id
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", cherries, "ripe")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(store.Close() == nil, "")
+
+	// A new server on the same directory picks up where the old one left off
+	store = openFileStore(t, dir)
+	assert.Equal(store.Len(), 3)
+	assert.Equal(len(store.Users()), 2)
+	conversation := store.Conversation(cherries)
+	assert.NotNil(conversation)
+	assert.Equal(len(conversation.Messages), 2)
+	assert.Equal(conversation.Messages[1].Body, "ripe")
+
+	// and keeps numbering taps from there
+	restarted := newServer(store)
+	alex := connect(restarted, "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, alex), "") // sean auth, conversation, message, alex auth
+	assert.Equal(alex.data.Conversations[cherries].Messages[1].Body, "ripe")
+	assert.Equal(store.Len(), 4)
+}
+
+func TestTapLogFailures(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+	store := openFileStore(t, dir)
+	server := newServer(store)
+	sean := connect(server, "sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+
+	// A tap that Data rejects never reaches the log
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", "nowhere", "hello?")
+	errorTap := <-sean.syncToUser
+	assert.Equal(errorTap.Value, "Conversation 'nowhere' not found")
+	b, err := ioutil.ReadFile(filepath.Join(dir, "taps.log"))
+	assert.True(err == nil, "")
+	assert.Equal(strings.Count(string(b), "\n"), 1)
+
+	// and one that can't be written is refused rather than acked
+	store.log.file.Close()
+	sean.userToSync <- NewConversationTap("sean", "limes")
+	errorTap = <-sean.syncToUser
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+	assert.Equal(errorTap.Value, ErrNotStored.Error())
+	assert.Equal(store.Len(), 1)
+
+	// so that a restart agrees with what everyone was told
+	restarted := openFileStore(t, dir)
+	assert.Equal(restarted.Len(), 1)
+	restarted.Close()
+}
+
+func TestSnapshots(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+	store := openFileStore(t, dir)
+	server := newServer(store)
+
+	sean := connect(server, "sean")
+	sean.userToSync <- NewConversationTap("sean", "plums")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	plums := titled(sean.data, "plums").Id
+	assert.True(store.Snapshot() == nil, "")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", plums, "purple")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(store.Snapshot() == nil, "")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", plums, "juicy")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(store.Close() == nil, "")
+
+	// The snapshots hold the taps they cover, so the log only keeps those
+	// the older one doesn't
+	ids, err := snapshotIds(dir)
+	assert.True(err == nil, "")
+	assert.Equal(ids, []int{2, 1})
+	taps := logTaps(t, dir)
+	assert.Equal(len(taps), 2)
+	assert.Equal(taps[0].Id, 2)
+	data, id, err := LoadSnapshot(dir)
+	assert.True(err == nil, "")
+	assert.Equal(id, 2)
+	assert.Equal(len(data.Taps), 3)
+
+	store = openFileStore(t, dir)
+	assert.Equal(store.Len(), 4)
+	assert.Equal(len(store.Conversation(plums).Messages), 3)
+	assert.Equal(len(store.ConversationTaps(plums, 4)), 3)
+	assert.True(store.Close() == nil, "")
+
+	// Corrupting the newest snapshot falls back to the older one
+	err = ioutil.WriteFile(snapshotPath(dir, 2), []byte(`{"lastTapId":2,`), 0644)
+	assert.True(err == nil, "")
+	store = openFileStore(t, dir)
+	assert.Equal(store.Len(), 4)
+	assert.Equal(store.Conversation(plums).Messages[2].Body, "juicy")
+	assert.True(store.Close() == nil, "")
+
+	// but without any snapshot the log is missing its start, which is refused
+	err = ioutil.WriteFile(snapshotPath(dir, 1), []byte(`{"lastTapId":1,`), 0644)
+	assert.True(err == nil, "")
+	_, err = OpenFileStore(dir, SYNC_NEVER, 0)
+	assert.NotNil(err)
+}
+
+func TestSnapshotMemberships(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+	store := openFileStore(t, dir)
+	store.Append(&Tap{Type: TYPE_AUTH, User: "sean"})
+	store.Append(&Tap{Type: TYPE_AUTH, User: "alex"})
+	store.Append(NewConversationTap("sean", "pears", "alex"))
+	store.Append(NewTap(TYPE_MESSAGE, "alex", "2", "ripe"))
+	store.Append(&Tap{Type: TYPE_LEAVE, User: "alex", Conversation: "2"})
+	store.Append(NewTap(TYPE_MESSAGE, "sean", "2", "gone"))
+	store.Append(&Tap{Type: TYPE_INVITE, User: "sean", Conversation: "2", Args: []string{"john"}})
+	alex, _ := store.UserTaps("alex", 0)
+	john, _ := store.UserTaps("john", 0)
+	assert.Equal(len(alex), 5) // auths, conversation, message, leave
+	assert.True(store.Snapshot() == nil, "")
+	assert.True(store.Close() == nil, "")
+
+	// Reopened from the snapshot, alex still has the taps from before they
+	// left and john still only those from after he joined
+	store = openFileStore(t, dir)
+	defer store.Close()
+	taps, _ := store.UserTaps("alex", 0)
+	assert.Equal(taps, alex)
+	taps, _ = store.UserTaps("john", 0)
+	assert.Equal(taps, john)
+}
+
+func logTaps(t *testing.T, dir string) []*Tap {
+	log, err := OpenTapLog(filepath.Join(dir, "taps.log"), SYNC_NEVER, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	taps := make([]*Tap, 0)
+	log.Replay(func(tap *Tap) error {
+		taps = append(taps, tap)
+		return nil
+	})
+	return taps
+}
+
+func TestPasswordAuth(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	sean := connect(server, "sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+
+	// An impostor is turned away without disturbing sean
+	impostor := login(server, NewConnTapClient("sean", "guess"))
+	errorTap := <-impostor.syncToUser
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+	assert.Equal(errorTap.Value, ErrBadCredentials.Error())
+	_, ok := <-impostor.syncToUser
+	assert.False(ok, "")
+
+	// and so is anyone trying to register sean again
+	impostor = NewConnTapClient("sean", "guess")
+	impostor.register = true
+	errorTap = <-login(server, impostor).syncToUser
+	assert.Equal(errorTap.Value, ErrAlreadyRegistered.Error())
+
+	sean.userToSync <- NewConversationTap("sean", "figs")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+
+	// The real sean can log in again with his password, and no secret leaks
+	// into the taps
+	again := login(server, NewConnTapClient("sean", "password"))
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, again), "") // auth, conversation, auth
+	for _, tap := range server.store.Range(0, server.store.Len()) {
+		assert.Equal(tap.Secret, "")
+	}
+}
+
+func TestNamesInUse(t *testing.T) {
+	assert := assert.Assert(t)
+	store := NewMemStore()
+	store.Append(&Tap{Type: TYPE_AUTH, User: "alex"}) // from before passwords
+	server := newServer(store)
+
+	sean := connect(server, "sean")
+	sean.userToSync <- NewConversationTap("sean", "dates", "alex", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, sean), "")
+
+	// john has only been invited, so he registers as usual
+	john := connect(server, "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, john), "") // three auths, conversation
+	assert.NotNil(titled(john.data, "dates"))
+
+	// but alex has logged in before, so nobody may register as alex
+	impostor := NewConnTapClient("alex", "guess")
+	impostor.register = true
+	errorTap := <-login(server, impostor).syncToUser
+	assert.Equal(errorTap.Value, ErrNameInUse.Error())
+
+	// nor as an admin, who would then have the run of the server
+	impostor = NewConnTapClient("admin", "guess")
+	impostor.register = true
+	errorTap = <-login(server, impostor).syncToUser
+	assert.Equal(errorTap.Value, ErrNameReserved.Error())
+	assert.False(server.credentials.Has("admin"), "")
+
+	// Only an admin can give alex a password
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "") // john's auth
+	sean.userToSync <- &Tap{Type: TYPE_PASSWORD, Args: []string{"alex"}, Secret: "guess"}
+	errorTap = <-sean.syncToUser
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+	admin := connect(server, "admin")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, admin), "")
+	admin.userToSync <- &Tap{Type: TYPE_PASSWORD, Args: []string{"alex"}, Secret: "olives"}
+
+	// and alex logs in with it to find the conversation waiting
+	for i := 0; i < 100 && server.credentials.Verify("alex", "olives") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	alex := login(server, NewConnTapClient("alex", "olives"))
+	assert.True(drainWithin(DRAIN_TIMEOUT, 6, alex), "") // five auths, conversation
+	assert.NotNil(titled(alex.data, "dates"))
+}
+
+func TestSessionTokens(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	sean := connect(server, "sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(sean.token != "", "")
+
+	// The token works in place of the password
+	laptop := NewConnTapClient("sean", "")
+	laptop.token = sean.token
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, login(server, laptop)), "")
+
+	// until sean logs out
+	laptop.userToSync <- &Tap{Type: TYPE_LOGOUT}
+	_, ok := <-laptop.syncToUser
+	assert.False(ok, "")
+	stolen := NewConnTapClient("sean", "")
+	stolen.token = sean.token
+	errorTap := <-login(server, stolen).syncToUser
+	assert.Equal(errorTap.Value, ErrBadToken.Error())
+	assert.Equal(stolen.token, "")
+
+	// Only admins can revoke other users' tokens
+	alex := connect(server, "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, alex), "") // sean twice, alex
+	alex.userToSync <- &Tap{Type: TYPE_REVOKE, Args: []string{"john"}}
+	errorTap = <-alex.syncToUser
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+
+	admin := connect(server, "admin")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, admin), "")
+	admin.userToSync <- &Tap{Type: TYPE_REVOKE, Args: []string{"alex"}}
+	_, ok = <-alex.syncToUser
+	for ok {
+		_, ok = <-alex.syncToUser
+	}
+	stolen = NewConnTapClient("alex", "")
+	stolen.token = alex.token
+	errorTap = <-login(server, stolen).syncToUser
+	assert.Equal(errorTap.Value, ErrBadToken.Error())
+}
+
+// writeCert writes a PEM certificate and key for commonName to dir, signed
+// by parent (or self-signed if parent is nil).
+func writeCert(t *testing.T, dir, commonName string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	ioutil.WriteFile(filepath.Join(dir, commonName+".crt"), certPem, 0644)
+	ioutil.WriteFile(filepath.Join(dir, commonName+".key"), keyPem, 0600)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return &cert
+}
+
+func TestMutualTLS(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+	ca := writeCert(t, dir, "ca", nil)
+	writeCert(t, dir, "localhost", ca)
+	writeCert(t, dir, "sean", ca)
+
+	serverTLS, err := ServerTLSConfig(filepath.Join(dir, "localhost.crt"),
+		filepath.Join(dir, "localhost.key"), filepath.Join(dir, "ca.crt"))
+	assert.True(err == nil, "")
+	server := newServer(NewMemStore())
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
+	assert.True(err == nil, "")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConn(conn)
+		}
+	}()
+
+	dial := func(user string) (<-chan *Tap, chan<- *Tap) {
+		clientTLS, err := ClientTLSConfig(filepath.Join(dir, "ca.crt"),
+			filepath.Join(dir, "sean.crt"), filepath.Join(dir, "sean.key"))
+		assert.True(err == nil, "")
+		clientTLS.ServerName = "localhost"
+		conn, err := tls.Dial("tcp", listener.Addr().String(), clientTLS)
+		assert.True(err == nil, "")
+		inbox, outbox := connToChan(conn, nil)
+		authTap := NewTap(TYPE_REGISTER, user, "", "0")
+		authTap.Secret = "password"
+		outbox <- authTap
+		return inbox, outbox
+	}
+
+	// sean's certificate lets him in as sean
+	inbox, outbox := dial("sean")
+	assert.Equal((<-inbox).Type, TYPE_TOKEN)
+	assert.Equal((<-inbox).Type, TYPE_AUTH)
+	close(outbox)
+
+	// but not as anyone else
+	inbox, outbox = dial("alex")
+	errorTap := <-inbox
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+	assert.Equal(errorTap.Value, "Client certificate does not match user")
+	close(outbox)
+}
+
+func TestMultipleSessions(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	sean := connect(server, "sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	laptop := login(server, NewConnTapClient("sean", "password"))
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, laptop), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "") // the laptop's auth
+
+	// Both of sean's sessions see what either of them does
+	laptop.userToSync <- NewConversationTap("sean", "kiwis")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, laptop), "")
+	assert.NotNil(titled(sean.data, "kiwis"))
+	assert.NotNil(titled(laptop.data, "kiwis"))
+
+	// With single sessions, logging in again ends the other sessions
+	server.config.SingleSession = true
+	phone := login(server, NewConnTapClient("sean", "password"))
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, phone), "")
+	for _, client := range []*ConnTapClient{sean, laptop} {
+		_, ok := <-client.syncToUser
+		for ok {
+			_, ok = <-client.syncToUser
+		}
+	}
+}
+
+func TestLeave(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	sean := connect(server, "sean")
+	alex := connect(server, "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, alex), "")
+	sean.userToSync <- NewConversationTap("sean", "limes", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	limes := titled(sean.data, "limes").Id
+
+	// alex leaves and everyone, alex included, hears about it
+	alex.userToSync <- NewTap(TYPE_LEAVE, "alex", limes, "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.False(server.store.Conversation(limes).HasUser("alex"), "")
+	assert.False(alex.data.Conversations[limes].HasUser("alex"), "")
+	assert.Equal(sean.data.Conversations[limes].LastMessage().Body, "alex left")
+
+	// alex no longer gets the conversation's taps
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", limes, "sour")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.False(drain(1, alex), "")
+
+	// until he is invited back, at which point it is replayed from scratch
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", limes, "", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, alex), "") // conversation, leave, message, invite
+	assert.True(alex.data.Conversations[limes].HasUser("alex"), "")
+	assert.Equal(len(alex.data.Conversations[limes].Messages), 4)
+}
+
+func TestRenameAndTopic(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	clients := connectAll(t, server, "sean", "alex", "john")
+	sean, alex, john := clients[0], clients[1], clients[2]
+	sean.userToSync <- NewConversationTap("sean", "kiwis", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	kiwis := titled(sean.data, "kiwis").Id
+
+	// members hear of a rename as a message
+	alex.userToSync <- NewTap(TYPE_RENAME, "alex", kiwis, "", "golden kiwis")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.False(drain(1, john), "")
+	assert.Equal(server.store.Conversation(kiwis).Title, "golden kiwis")
+	assert.Equal(sean.data.Conversations[kiwis].Title, "golden kiwis")
+	assert.Equal(sean.data.Conversations[kiwis].LastMessage().Body,
+		"alex renamed the conversation to golden kiwis")
+
+	// and of the topic changing
+	sean.userToSync <- NewTap(TYPE_TOPIC, "sean", kiwis, "", "fuzzy on the outside")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.Equal(alex.data.Conversations[kiwis].Topic, "fuzzy on the outside")
+	assert.Equal(alex.data.Conversations[kiwis].LastMessage().Body,
+		"sean set the topic to fuzzy on the outside")
+
+	// only members may do either, and a title can't be blank
+	john.userToSync <- NewTap(TYPE_TOPIC, "john", kiwis, "", "mine now")
+	errorTap := <-john.syncToUser
+	assert.Equal(errorTap.Value, "john is not in conversation '"+kiwis+"'")
+	sean.userToSync <- NewTap(TYPE_RENAME, "sean", kiwis, "", " ")
+	errorTap = <-sean.syncToUser
+	assert.Equal(errorTap.Value, "New title required")
+	assert.False(drain(1, alex), "")
+
+	// someone invited later catches up on both
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", kiwis, "", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, john), "") // conversation, rename, topic, invite
+	assert.Equal(john.data.Conversations[kiwis].Title, "golden kiwis")
+	assert.Equal(john.data.Conversations[kiwis].Topic, "fuzzy on the outside")
+
+	// and clearing the topic
+	sean.userToSync <- NewTap(TYPE_TOPIC, "sean", kiwis, "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, john), "")
+	assert.Equal(john.data.Conversations[kiwis].Topic, "")
+	assert.Equal(john.data.Conversations[kiwis].LastMessage().Body, "sean cleared the topic")
+}
+
+func TestTimestamps(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	sean := connectAll(t, server, "sean")[0]
+	before := time.Now()
+	sean.userToSync <- NewConversationTap("sean", "plums")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+
+	// the server's clock is the one that counts
+	tap := NewTap(TYPE_MESSAGE, "sean", titled(sean.data, "plums").Id, "ripe")
+	tap.Time = before.Add(-time.Hour)
+	sean.userToSync <- tap
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	message := titled(sean.data, "plums").LastMessage()
+	assert.False(message.Time.Before(before), "")
+	assert.False(message.Time.After(time.Now()), "")
+	stored := server.store.Range(message.TapId, message.TapId+1)[0]
+	assert.True(stored.Time.Equal(message.Time), "")
+
+	// taps the server didn't stamp, like pings, go without a time
+	b, err := json.Marshal(&Tap{Type: TYPE_PING})
+	assert.True(err == nil, "")
+	assert.False(strings.Contains(string(b), "time"), string(b))
+
+	now := time.Date(2014, 6, 3, 12, 30, 0, 0, time.Local)
+	assert.Equal(relativeTime(now.Add(-10*time.Second), now), "just now")
+	assert.Equal(relativeTime(now.Add(-5*time.Minute), now), "5m ago")
+	assert.Equal(relativeTime(now.Add(-3*time.Hour), now), "3h ago")
+	assert.Equal(relativeTime(now.Add(-50*time.Hour), now), "2d ago")
+	assert.Equal(relativeTime(time.Time{}, now), "")
+	assert.Equal(absoluteTime(now.Add(-time.Hour), now), "11:30")
+	assert.Equal(absoluteTime(now.Add(-24*time.Hour), now), "Jun 2 12:30")
+	assert.Equal(absoluteTime(now.AddDate(-1, 0, 0), now), "Jun 3 2013 12:30")
+}
+
+func TestEditAndDelete(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	clients := connectAll(t, server, "sean", "alex", "john")
+	sean, alex, john := clients[0], clients[1], clients[2]
+	sean.userToSync <- NewConversationTap("sean", "dates", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	dates := titled(sean.data, "dates")
+	assert.Equal(dates.Creator, "sean")
+	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", dates.Id, "medjool")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", dates.Id, "deglet")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	alexId := strconv.Itoa(dates.Messages[1].TapId)
+	seanId := strconv.Itoa(dates.Messages[2].TapId)
+
+	// alex edits his message and everyone in the conversation sees it
+	alex.userToSync <- NewTap(TYPE_EDIT, "alex", dates.Id, "medjool, please", alexId)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.False(drain(1, john), "")
+	assert.Equal(dates.Messages[1].String(), "alex: medjool, please (edited)")
+	stored := server.store.Conversation(dates.Id).Messages[1]
+	assert.Equal(stored.Body, "medjool, please")
+
+	// but he may not touch sean's, nor what isn't a message
+	alex.userToSync <- NewTap(TYPE_DELETE, "alex", dates.Id, "", seanId)
+	errorTap := <-alex.syncToUser
+	assert.Equal(errorTap.Value, "Only its author or the conversation's creator may change a message")
+	alex.userToSync <- NewTap(TYPE_EDIT, "alex", dates.Id, "mine", dates.Id)
+	errorTap = <-alex.syncToUser
+	assert.Equal(errorTap.Value, "Message "+dates.Id+" not found")
+	john.userToSync <- NewTap(TYPE_DELETE, "john", dates.Id, "", alexId)
+	errorTap = <-john.syncToUser
+	assert.Equal(errorTap.Value, "john is not in conversation '"+dates.Id+"'")
+
+	// sean created the conversation, so he may delete alex's message
+	sean.userToSync <- NewTap(TYPE_DELETE, "sean", dates.Id, "", alexId)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.Equal(alex.data.Conversations[dates.Id].Messages[1].String(), "alex: (message deleted)")
+	alex.userToSync <- NewTap(TYPE_EDIT, "alex", dates.Id, "again", alexId)
+	errorTap = <-alex.syncToUser
+	assert.Equal(errorTap.Value, "Message "+alexId+" was deleted")
+
+	// someone invited later sees the same, without ever getting what was
+	// deleted or edited away
+	sean.userToSync <- NewTap(TYPE_EDIT, "sean", dates.Id, "deglet noor", seanId)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", dates.Id, "", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 7, john), "") // conversation, two messages, two edits, delete, invite
+	replayed := john.data.Conversations[dates.Id].Messages[1]
+	assert.True(replayed.Deleted && replayed.Body == "", "")
+	assert.Equal(john.data.Conversations[dates.Id].Messages[2].String(), "sean: deglet noor (edited)")
+	for _, tap := range server.store.ConversationTaps(dates.Id, server.store.Len()) {
+		assert.False(strings.Contains(tap.Value, "medjool"), tap.Value)
+		assert.True(tap.Value != "deglet", "")
+	}
+	assert.Equal(server.store.Range(0, server.store.Len())[dates.Messages[1].TapId].Value, "medjool")
+}
+
+func TestThreads(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	clients := connectAll(t, server, "sean", "alex", "john")
+	sean, alex, john := clients[0], clients[1], clients[2]
+	sean.userToSync <- NewConversationTap("sean", "grapes", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	grapes := titled(sean.data, "grapes")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", grapes.Id, "red or green?")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	root := grapes.LastMessage().TapId
+
+	reply := NewTap(TYPE_MESSAGE, "alex", grapes.Id, "red")
+	reply.Parent = root
+	alex.userToSync <- reply
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	first := grapes.LastMessage().TapId
+
+	// a reply to a reply joins the thread it is in
+	reply = NewTap(TYPE_MESSAGE, "sean", grapes.Id, "seedless?")
+	reply.Parent = first
+	sean.userToSync <- reply
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.Equal(grapes.LastMessage().Parent, root)
+	assert.Equal(grapes.Message(root).Replies, []int{first, grapes.LastMessage().TapId})
+	assert.Equal(alex.data.Conversations[grapes.Id].Message(root).Replies,
+		grapes.Message(root).Replies)
+
+	// only messages in the conversation can be replied to
+	reply = NewTap(TYPE_MESSAGE, "alex", grapes.Id, "hm")
+	reply.Parent = grapes.TapId
+	alex.userToSync <- reply
+	errorTap := <-alex.syncToUser
+	assert.Equal(errorTap.Value, fmt.Sprintf("Message %d not found", grapes.TapId))
+
+	// someone invited later gets the same threads
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", grapes.Id, "", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 5, john), "") // conversation, message, two replies, invite
+	replayed := john.data.Conversations[grapes.Id]
+	assert.Equal(replayed.Message(root).Replies, grapes.Message(root).Replies)
+	assert.Equal(replayed.Message(first).Parent, root)
+
+	// and copies don't share them
+	copied := server.store.Conversation(grapes.Id)
+	copied.Message(root).Replies[0] = -1
+	assert.Equal(server.store.Conversation(grapes.Id).Message(root).Replies[0], first)
+
+	tapId, rest, ok := splitMessageId(" #12 sounds good ")
+	assert.True(ok && tapId == 12 && rest == "sounds good", "")
+	_, _, ok = splitMessageId("12 sounds good")
+	assert.False(ok, "")
+}
+
+func TestReactions(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	clients := connectAll(t, server, "sean", "alex", "john")
+	sean, alex, john := clients[0], clients[1], clients[2]
+	sean.userToSync <- NewConversationTap("sean", "mangoes", "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	mangoes := titled(sean.data, "mangoes")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", mangoes.Id, "ataulfo")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	tapId := mangoes.LastMessage().TapId
+	target := strconv.Itoa(tapId)
+
+	// members see reactions add up, and nobody else hears of them
+	sean.userToSync <- NewTap(TYPE_REACT, "sean", mangoes.Id, "+1", target)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	alex.userToSync <- NewTap(TYPE_REACT, "alex", mangoes.Id, "+1", target)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	alex.userToSync <- NewTap(TYPE_REACT, "alex", mangoes.Id, "yum", target)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.False(drain(1, john), "")
+	assert.Equal(reactionSummary(mangoes.LastMessage().Reactions), "+1 x2  yum x1")
+
+	// reacting the same way again takes it back
+	sean.userToSync <- NewTap(TYPE_REACT, "sean", mangoes.Id, "+1", target)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	alex.userToSync <- NewTap(TYPE_REACT, "alex", mangoes.Id, "yum", target)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.Equal(alex.data.Conversations[mangoes.Id].LastMessage().Reactions,
+		map[string][]string{"+1": []string{"alex"}})
+	stored := server.store.Conversation(mangoes.Id).LastMessage()
+	assert.Equal(stored.Reactions, map[string][]string{"+1": []string{"alex"}})
+
+	// only members can react, with something
+	john.userToSync <- NewTap(TYPE_REACT, "john", mangoes.Id, "+1", target)
+	errorTap := <-john.syncToUser
+	assert.Equal(errorTap.Value, "john is not in conversation '"+mangoes.Id+"'")
+	sean.userToSync <- NewTap(TYPE_REACT, "sean", mangoes.Id, "", target)
+	errorTap = <-sean.syncToUser
+	assert.Equal(errorTap.Value, "Value (reaction, without spaces) required")
+
+	// someone invited later sees the same
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", mangoes.Id, "", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 8, john), "") // conversation, message, five reactions, invite
+	assert.Equal(reactionSummary(john.data.Conversations[mangoes.Id].Message(tapId).Reactions), "+1 x1")
+
+	// but inviting someone who is already there is refused, not replayed
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "") // john's invite
+	sean.userToSync <- NewTap(TYPE_INVITE, "sean", mangoes.Id, "", "alex")
+	errorTap = <-sean.syncToUser
+	assert.Equal(errorTap.Value, "alex is already in conversation '"+mangoes.Id+"'")
+	assert.False(drain(1, alex), "")
+
+	// and a conversation replayed to a client that has it changes nothing
+	replayed := john.data.Conversations[mangoes.Id]
+	messages := len(replayed.Messages)
+	for _, tap := range server.store.ConversationTaps(mangoes.Id, server.store.Len()) {
+		copied := *tap
+		john.data.Update(&copied)
+	}
+	assert.Equal(len(replayed.Messages), messages)
+	assert.Equal(reactionSummary(replayed.Message(tapId).Reactions), "+1 x1")
+}
+
+func TestReadMarkers(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	clients := connectAll(t, server, "sean", "alex", "john")
+	sean, alex, john := clients[0], clients[1], clients[2]
+	laptop := login(server, NewConnTapClient("sean", "password"))
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, laptop), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, john), "")
+
+	alex.userToSync <- NewConversationTap("alex", "papayas", "sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	papayas := titled(alex.data, "papayas").Id
+	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", papayas, "ripe?")
+	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", papayas, "very")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, alex), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, laptop), "")
+	conversation := sean.data.Conversations[papayas]
+	assert.Equal(conversation.Unread("sean"), 3)
+	assert.Equal(conversation.Unread("alex"), 0)
+
+	// sean reads it on one session, and his other session hears but nobody
+	// else does
+	last := strconv.Itoa(conversation.LastMessage().TapId)
+	sean.userToSync <- NewTap(TYPE_READ, "sean", papayas, "", last)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, laptop), "")
+	assert.False(drain(1, alex), "")
+	assert.Equal(conversation.Unread("sean"), 0)
+	assert.Equal(laptop.data.Conversations[papayas].Unread("sean"), 0)
+	assert.Equal(server.store.Conversation(papayas).Read["sean"], conversation.LastMessage().TapId)
+	assert.Equal(alex.data.Conversations[papayas].Read["sean"], 0)
+
+	// markers never move back, nor ahead of what has happened
+	laptop.userToSync <- NewTap(TYPE_READ, "sean", papayas, "", papayas)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, laptop), "")
+	assert.Equal(conversation.Unread("sean"), 0)
+	laptop.userToSync <- NewTap(TYPE_READ, "sean", papayas, "", "1000")
+	errorTap := <-laptop.syncToUser
+	assert.Equal(errorTap.Value, "Bad tap id '1000'")
+
+	// someone invited later doesn't learn what sean has read
+	alex.userToSync <- NewTap(TYPE_INVITE, "alex", papayas, "", "john")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, alex), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 4, john), "") // conversation, two messages, invite
+	assert.False(drain(1, john), "")
+	assert.Equal(len(john.data.Conversations[papayas].Read), 0)
+
+	// A client only marks what it has read on opening and closing a
+	// conversation, not every time the view refreshes
+	client := NewConnTapClient("sean", "password")
+	client.userToSync = make(chan *Tap, 10)
+	for _, tap := range server.store.Range(0, server.store.Len()) {
+		copied := *tap
+		client.data.Update(&copied)
+	}
+	client.openConversation("papayas") // john's invite is new to sean
+	client.printMessages(true)
+	client.printMessages(false)
+	assert.Equal(len(client.userToSync), 1)
+	client.handleCmd("close")
+	assert.Equal(len(client.userToSync), 1)
+	<-client.userToSync
+	client.openConversation("papayas")
+	said := NewTap(TYPE_MESSAGE, "alex", papayas, "sweet")
+	said.Id = server.store.Len()
+	assert.True(client.data.Update(said) == nil, "")
+	client.printMessages(false)
+	assert.Equal(len(client.userToSync), 0)
+	client.handleCmd("close")
+	assert.Equal(len(client.userToSync), 1)
+	tap := <-client.userToSync
+	assert.Equal(tap.Type, TYPE_READ)
+	assert.Equal(tap.Args, []string{strconv.Itoa(said.Id)})
+
+	// and waits for sync rather than dropping the marker when it's busy
+	client.userToSync = make(chan *Tap)
+	said = NewTap(TYPE_MESSAGE, "alex", papayas, "sweeter")
+	said.Id = server.store.Len() + 1
+	assert.True(client.data.Update(said) == nil, "")
+	go client.openConversation("papayas")
+	tap = <-client.userToSync
+	assert.Equal(tap.Args, []string{strconv.Itoa(said.Id)})
+
+	// the inbox puts unread conversations first, then the most recent
+	quiet := &Conversation{Messages: []*Message{&Message{TapId: 9}}}
+	recent := &Conversation{Messages: []*Message{&Message{TapId: 12}}}
+	unread := &Conversation{Messages: []*Message{&Message{TapId: 5}}}
+	entries := byUnread{{quiet, 0}, {unread, 2}, {recent, 0}}
+	sort.Sort(entries)
+	assert.True(entries[0].conversation == unread, "")
+	assert.True(entries[1].conversation == recent, "")
+	assert.True(entries[2].conversation == quiet, "")
+}
+
+// benchStore builds a store of 100k+ taps: 100 users chatting in 500
+// conversations of 3 users each.
+func benchStore(b *testing.B) *MemStore {
+	store := NewMemStore()
+	users := make([]string, 100)
+	for i := range users {
+		users[i] = fmt.Sprintf("user%d", i)
+		store.Append(NewTap(TYPE_AUTH, users[i], "", ""))
+	}
+	ids := make([]string, 500)
+	for i := range ids {
+		tap := NewConversationTap(users[i%100], fmt.Sprintf("conversation%d", i),
+			users[(i+1)%100], users[(i+2)%100])
+		store.Append(tap)
+		ids[i] = tap.Conversation
+	}
+	for i := 0; store.Len() < 100000; i++ {
+		store.Append(NewTap(TYPE_MESSAGE, users[i%100], ids[(i*7)%500], "hello"))
+	}
+	b.ResetTimer()
+	return store
+}
+
+func BenchmarkCatchUpLinear(b *testing.B) {
+	store := benchStore(b)
+	server := &ConnTapServer{store: store}
+	for n := 0; n < b.N; n++ {
+		for _, tap := range store.Range(0, store.Len()) {
+			server.isRelevant("user0", tap)
+		}
+	}
+}
+
+func BenchmarkCatchUpIndexed(b *testing.B) {
+	store := benchStore(b)
+	for n := 0; n < b.N; n++ {
+		store.UserTaps("user0", 0)
+	}
+}
+
+func BenchmarkReplayLinear(b *testing.B) {
+	store := benchStore(b)
+	for n := 0; n < b.N; n++ {
+		taps := make([]*Tap, 0)
+		for _, tap := range store.Range(0, store.Len()) {
+			if tap.Conversation == "100" { // conversation0
+				taps = append(taps, tap)
+			}
+		}
+	}
+}
+
+func BenchmarkReplayIndexed(b *testing.B) {
+	store := benchStore(b)
+	for n := 0; n < b.N; n++ {
+		store.ConversationTaps("100", store.Len())
+	}
+}
+
+func TestManyClients(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	const numClients, numMessages = 20, 5
+	clients := make([]*ConnTapClient, numClients)
+	users := make([]string, numClients)
+	for i := range clients {
+		users[i] = fmt.Sprintf("user%d", i)
+		clients[i] = connect(server, users[i])
+	}
+
+	// run f for every client at once and wait for them all
+	all := func(f func(i int, client *ConnTapClient) bool) {
+		var wg sync.WaitGroup
+		ok := make([]bool, numClients)
+		for i, client := range clients {
+			wg.Add(1)
+			go func(i int, client *ConnTapClient) {
+				defer wg.Done()
+				ok[i] = f(i, client)
+			}(i, client)
+		}
+		wg.Wait()
+		for i := range ok {
+			assert.True(ok[i], "client %d", i)
+		}
+	}
+
+	all(func(i int, client *ConnTapClient) bool {
+		return drainWithin(DRAIN_TIMEOUT, numClients, client) // everyone's auth
+	})
+	clients[0].userToSync <- NewConversationTap(users[0], "crowd", users[1:]...)
+	all(func(i int, client *ConnTapClient) bool {
+		return drainWithin(DRAIN_TIMEOUT, 1, client)
+	})
+	crowd := titled(clients[0].data, "crowd").Id
+
+	// everyone talks at once
+	all(func(i int, client *ConnTapClient) bool {
+		go func() {
+			for n := 0; n < numMessages; n++ {
+				client.userToSync <- NewTap(TYPE_MESSAGE, users[i], crowd, "hi")
+			}
+		}()
+		return drainWithin(DRAIN_TIMEOUT, numClients*numMessages, client)
+	})
+	for _, client := range clients {
+		assert.Equal(len(client.data.Conversations[crowd].Messages), 1+numClients*numMessages)
+	}
+	assert.Equal(len(server.store.Conversation(crowd).Messages), 1+numClients*numMessages)
+}
+
+func TestErrorReplies(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	sean := connect(server, "sean")
+	alex := connect(server, "alex")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, alex), "")
+	sean.userToSync <- NewConversationTap("sean", "pears")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+
+	// A conversation needs a title, and only sean hears that it didn't
+	sean.userToSync <- NewConversationTap("sean", "")
+	errorTap := <-sean.syncToUser
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+	assert.Equal(errorTap.Value, "Conversation title required")
+	assert.Equal(errorTap.Args, []string{TYPE_CONVERSATION})
+	assert.False(drain(1, alex), "")
+
+	// but titles need not be unique
+	sean.userToSync <- NewConversationTap("sean", "pears")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.Equal(len(sean.data.Conversations), 2)
+
+	// as is talking in a conversation that doesn't exist
+	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", "apricots", "hello?")
+	errorTap = <-alex.syncToUser
+	assert.Equal(errorTap.Conversation, "apricots")
+	assert.Equal(errorTap.Value, "Conversation 'apricots' not found")
+	assert.False(drain(1, sean), "")
+
+	// and guessing the id of a conversation one isn't in gets nowhere
+	pears := titled(sean.data, "pears").Id
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", pears, "just between us")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	alex.userToSync <- NewTap(TYPE_MESSAGE, "alex", pears, "hi!")
+	errorTap = <-alex.syncToUser
+	assert.Equal(errorTap.Value, "alex is not in conversation '"+pears+"'")
+	alex.userToSync <- NewTap(TYPE_INVITE, "alex", pears, "", "alex")
+	errorTap = <-alex.syncToUser
+	assert.Equal(errorTap.Value, "alex is not in conversation '"+pears+"'")
+	assert.False(drain(1, alex), "")
+	assert.False(drain(1, sean), "")
+	assert.False(server.store.Conversation(pears).HasUser("alex"), "")
+	assert.Equal(len(server.store.Conversation(pears).Messages), 2)
+
+	// Taps the server can't apply are refused rather than stored
+	length := server.store.Len()
+	for _, kind := range []string{"shout", TYPE_ACK} {
+		sean.userToSync <- NewTap(kind, "sean", pears, "hello")
+		errorTap = <-sean.syncToUser
+		assert.Equal(errorTap.Type, TYPE_ERROR)
+		assert.Equal(errorTap.Value, "Unknown tap type '"+kind+"'")
+	}
+	assert.False(drain(1, alex), "")
+	assert.Equal(server.store.Len(), length)
+}
+
+func TestRequestAcks(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+
+	clientToServer := make(chan *Tap, 10)
+	serverToClient := make(chan *Tap, 10)
+	go server.handle(clientToServer, serverToClient, "")
+	authTap := NewTap(TYPE_REGISTER, "sean", "", "0")
+	authTap.Secret = "password"
+	clientToServer <- authTap
+	assert.Equal((<-serverToClient).Type, TYPE_TOKEN)
+	assert.Equal((<-serverToClient).Type, TYPE_AUTH)
+
+	// The sender gets an ack with the id the server assigned
+	tap := NewConversationTap("sean", "grapes")
+	tap.Request = "r1"
+	clientToServer <- tap
+	ack, conversationTap := <-serverToClient, <-serverToClient
+	if conversationTap.Type == TYPE_ACK {
+		ack, conversationTap = conversationTap, ack
+	}
+	assert.Equal(ack.Type, TYPE_ACK)
+	assert.Equal(ack.Request, "r1")
+	assert.Equal(ack.Value, "1")
+	assert.Equal(conversationTap.Title, "grapes")
+
+	// A retry is acked again but not applied twice
+	retry := NewConversationTap("sean", "grapes")
+	retry.Request = "r1"
+	clientToServer <- retry
+	ack = <-serverToClient
+	assert.Equal(ack.Type, TYPE_ACK)
+	assert.Equal(ack.Value, "1")
+	assert.Equal(server.store.Len(), 2)
+
+	// Errors carry the request id too
+	tap = NewTap(TYPE_MESSAGE, "sean", "melons", "hi")
+	tap.Request = "r2"
+	clientToServer <- tap
+	errorTap := <-serverToClient
+	assert.Equal(errorTap.Type, TYPE_ERROR)
+	assert.Equal(errorTap.Request, "r2")
+	close(clientToServer)
+}
+
+func TestRequestWindow(t *testing.T) {
+	assert := assert.Assert(t)
+	store := NewMemStore()
+	for i := 0; i <= REQUESTS_KEPT; i++ {
+		tap := &Tap{Type: TYPE_AUTH, User: "sean", Request: "r" + strconv.Itoa(i)}
+		assert.True(store.Append(tap) == nil, "")
+	}
+
+	// Only the most recent requests are remembered, and only for their user
+	_, ok := store.Request("sean", "r0")
+	assert.False(ok, "")
+	tapId, ok := store.Request("sean", "r1")
+	assert.True(ok, "")
+	assert.Equal(tapId, 1)
+	tapId, ok = store.Request("sean", "r"+strconv.Itoa(REQUESTS_KEPT))
+	assert.True(ok, "")
+	assert.Equal(tapId, REQUESTS_KEPT)
+	_, ok = store.Request("alex", "r1")
+	assert.False(ok, "")
+}
+
+func TestReconnect(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.True(err == nil, "")
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConn(conn)
+		}
+	}()
+
+	sean := NewConnTapClient("sean", "password")
+	sean.register = true
+	go sean.run(listener.Addr().String())
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	sean.userToSync <- NewConversationTap("sean", "plums")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	sean.lock.Lock()
+	plums := titled(sean.data, "plums").Id
+	sean.lock.Unlock()
+
+	// Drop the connection; the client comes back with its token and only
+	// receives what it has not seen
+	server.endSessions("sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	assert.False(drain(1, sean), "")
+	sean.lock.Lock()
+	assert.False(sean.register, "")
+	assert.Equal(sean.cursor, server.store.Len())
+	sean.lock.Unlock()
+	assert.Equal(len(server.store.Range(0, server.store.Len())), 3)
+
+	// and carries on where it left off
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", plums, "still here")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	sean.lock.Lock()
+	assert.Equal(len(sean.data.Conversations[plums].Messages), 2)
+	sean.lock.Unlock()
+	close(sean.userToSync)
+}
+
+func TestOutbox(t *testing.T) {
+	assert := assert.Assert(t)
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	server := newServer(NewMemStore())
+	seed := connect(server, "sean")
+	seed.userToSync <- NewConversationTap("sean", "figs")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, seed), "")
+	figs := titled(seed.data, "figs").Id
+
+	// Queued taps survive a restart, in order
+	outbox, err := OpenOutbox(path)
+	assert.True(err == nil, "")
+	for i, value := range []string{"one", "two", "three"} {
+		tap := NewTap(TYPE_MESSAGE, "sean", figs, value)
+		tap.Request = fmt.Sprintf("r%d", i)
+		assert.True(outbox.Add(tap) == nil, "")
+	}
+	removed, err := outbox.Remove("r1")
+	assert.True(removed && err == nil, "")
+	removed, _ = outbox.Remove("r1")
+	assert.False(removed, "")
+	outbox, err = OpenOutbox(path)
+	assert.True(err == nil, "")
+	taps := outbox.Taps()
+	assert.Equal(len(taps), 2)
+	assert.Equal(taps[0].Value, "one")
+	assert.Equal(taps[1].Value, "three")
+
+	// and a client sends them once it is logged in
+	sean := NewConnTapClient("sean", "password")
+	sean.pending = outbox
+	sean = login(server, sean)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 5, sean), "") // two auths, figs and both messages
+	sean.lock.Lock()
+	assert.Equal(sean.pending.Len(), 0)
+	assert.Equal(len(sean.data.Conversations[figs].Messages), 3)
+	sean.lock.Unlock()
+	outbox, _ = OpenOutbox(path)
+	assert.Equal(outbox.Len(), 0)
+}
+
+func TestOfflineQueue(t *testing.T) {
+	assert := assert.Assert(t)
+	server := newServer(NewMemStore())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.True(err == nil, "")
+	address := listener.Addr().String()
+	serve := func(listener net.Listener) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConn(conn)
+		}
+	}
+	go serve(listener)
+
+	sean := NewConnTapClient("sean", "password")
+	sean.register = true
+	go sean.run(address)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	sean.userToSync <- NewConversationTap("sean", "figs")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	sean.lock.Lock()
+	figs := titled(sean.data, "figs").Id
+	sean.lock.Unlock()
+
+	// Take the server away; what sean types in the meantime waits
+	listener.Close()
+	server.endSessions("sean")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", figs, "anyone there?")
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", figs, "hello?")
+	assert.Equal(server.store.Len(), 2)
+
+	// and is sent in order once it is back
+	listener, err = net.Listen("tcp", address)
+	assert.True(err == nil, "")
+	defer listener.Close()
+	go serve(listener)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 3, sean), "")
+	messages := server.store.Conversation(figs).Messages
+	assert.Equal(len(messages), 3)
+	assert.Equal(messages[1].Body, "anyone there?")
+	assert.Equal(messages[2].Body, "hello?")
+	sean.lock.Lock()
+	assert.Equal(sean.pending.Len(), 0)
+	sean.lock.Unlock()
+	close(sean.userToSync)
+}
+
+func TestClientCache(t *testing.T) {
+	assert := assert.Assert(t)
+	path := filepath.Join(t.TempDir(), "cache.json")
+	server := newServer(NewMemStore())
+
+	sean := connect(server, "sean")
+	sean.cachePath = path
+	sean.userToSync <- NewConversationTap("sean", "dates")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 2, sean), "")
+	dates := titled(sean.data, "dates").Id
+	sean.userToSync <- NewTap(TYPE_MESSAGE, "sean", dates, "medjool")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	close(sean.userToSync)
+	_, ok := <-sean.syncToUser
+	assert.False(ok, "") // saved on the way out
+
+	// Starting again from the cache only fetches what is new
+	data, cursor, err := LoadClientCache(path)
+	assert.True(err == nil, "")
+	assert.Equal(cursor, 3)
+	assert.Equal(len(data.Conversations[dates].Messages), 2)
+	again := NewConnTapClient("sean", "password")
+	again.data, again.cursor = data, cursor
+	again = login(server, again)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, again), "")
+	assert.False(drain(1, again), "")
+	assert.Equal(again.data.Conversations[dates].LastMessage().Body, "medjool")
+
+	// A server that has lost its data turns the cache away, and the client
+	// starts over rather than keep what the server no longer has
+	fresh := newServer(NewMemStore())
+	stale := NewConnTapClient("sean", "password")
+	stale.register = true
+	stale.data, stale.cursor, err = LoadClientCache(path)
+	assert.True(err == nil, "")
+	stale = login(fresh, stale)
+	errorTap := <-stale.syncToUser
+	assert.Equal(errorTap.Value, ErrBadCursor.Error())
+	_, ok = <-stale.syncToUser
+	assert.False(ok, "")
+	assert.Equal(stale.cursor, 0)
+	assert.Equal(len(stale.data.Conversations), 0)
+	stale = login(fresh, stale)
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, stale), "") // sean's auth
+	assert.Equal(stale.cursor, fresh.store.Len())
+
+	// A missing cache is not an error
+	data, cursor, err = LoadClientCache(filepath.Join(t.TempDir(), "none.json"))
+	assert.True(err == nil && cursor == 0, "")
+	assert.Equal(len(data.Conversations), 0)
+}
+
+func TestHeartbeats(t *testing.T) {
+	assert := assert.Assert(t)
+	server := NewConnTapServer(NewMemStore(), ServerConfig{
+		Credentials: NewCredentials(1),
+		Heartbeat:   20 * time.Millisecond,
+		IdleTimeout: 200 * time.Millisecond,
+	})
+	sessions := func(server *ConnTapServer, user string) int {
+		server.sessionLock.Lock()
+		defer server.sessionLock.Unlock()
+		return len(server.sessions[user])
+	}
+
+	// A client that answers pings stays connected well past the timeout
+	sean := connect(server, "sean")
+	assert.True(drainWithin(DRAIN_TIMEOUT, 1, sean), "")
+	for start := time.Now(); time.Since(start) < 400*time.Millisecond; time.Sleep(10 * time.Millisecond) {
+		assert.Equal(sessions(server, "sean"), 1)
+	}
+
+	// while one that has gone quiet is dropped
+	quietSession := func(server *ConnTapServer, user string) <-chan *Tap {
+		clientToServer := make(chan *Tap, 10)
+		serverToClient := make(chan *Tap, 100)
+		go server.handle(clientToServer, serverToClient, "")
+		authTap := NewTap(TYPE_REGISTER, user, "", "0")
+		authTap.Secret = "password"
+		clientToServer <- authTap
+		return serverToClient
+	}
+	pings := 0
+	for tap := range quietSession(server, "alex") {
+		if tap.Type == TYPE_PING {
+			pings++
+		}
+	}
+	assert.True(pings > 0, "")
+	assert.Equal(sessions(server, "alex"), 0)
+
+	// and so is one that never logs in
+	clientToServer := make(chan *Tap, 10)
+	serverToClient := make(chan *Tap, 10)
+	go server.handle(clientToServer, serverToClient, "")
+	_, ok := <-serverToClient
+	assert.False(ok, "")
+
+	// even with pings turned off
+	unpinged := NewConnTapServer(NewMemStore(), ServerConfig{
+		Credentials: NewCredentials(1),
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	dropped := make(chan bool)
+	go func() {
+		for _ = range quietSession(unpinged, "john") {
+		}
+		close(dropped)
+	}()
+	select {
+	case <-dropped:
+	case <-time.After(DRAIN_TIMEOUT):
+		t.Fatal("A quiet session outlived the idle timeout with pings off")
+	}
+
+	// The client notices a silent server too, pinging it or not
+	for _, heartbeat := range []time.Duration{10 * time.Millisecond, 0} {
+		quiet := NewConnTapClient("sean", "password")
+		quiet.heartbeat = heartbeat
+		quiet.idleTimeout = 50 * time.Millisecond
+		inbox := make(chan *Tap)
+		outbox := make(chan *Tap, 100)
+		result := make(chan error)
+		go func() {
+			result <- quiet.sync(inbox, outbox)
+		}()
+		select {
+		case err := <-result:
+			assert.Equal(err, errDropped)
+		case <-time.After(DRAIN_TIMEOUT):
+			t.Fatalf("The client didn't notice a silent server with heartbeat %s", heartbeat)
+		}
+	}
+}
+
+func TestSlowConsumers(t *testing.T) {
+	assert := assert.Assert(t)
+	for _, policy := range []SlowConsumerPolicy{SLOW_DISCONNECT, SLOW_DROP} {
+		server := NewConnTapServer(NewMemStore(), ServerConfig{
+			Credentials:  NewCredentials(1),
+			SendQueue:    2,
+			SendTimeout:  20 * time.Millisecond,
+			SlowConsumer: policy,
+		})
+		clientToServer := make(chan *Tap, 20)
+		serverToClient := make(chan *Tap)
+		go server.handle(clientToServer, serverToClient, "")
+		authTap := NewTap(TYPE_REGISTER, "sean", "", "0")
+		authTap.Secret = "password"
+		clientToServer <- authTap
+		assert.Equal((<-serverToClient).Type, TYPE_TOKEN)
+
+		// sean stops reading while taps keep coming
+		for i := 0; i < 10; i++ {
+			clientToServer <- NewConversationTap("sean", fmt.Sprintf("c%d", i))
+		}
+		for i := 0; i < 100 && server.Stats().Sessions > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(server.Stats().SlowConsumers, int64(1))
+		assert.Equal(server.Stats().Sessions, 0)
+
+		// He gets what had been sent, then an error or nothing, and is gone
+		var last *Tap
+		received := 0
+		for tap := range serverToClient {
+			last = tap
+			received++
+		}
+		assert.True(received < 10, "")
+		assert.Equal(last.Type == TYPE_ERROR, policy == SLOW_DISCONNECT)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+	server := NewConnTapServer(openFileStore(t, dir), ServerConfig{
+		Credentials:      NewCredentials(1),
+		SnapshotInterval: time.Hour,
+	})
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.True(err == nil, "")
+	listener := &closeListener{Listener: tcpListener, closed: make(chan bool)}
+	go server.serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.True(err == nil, "")
+	inbox, outbox := connToChan(conn, nil)
+	authTap := NewTap(TYPE_REGISTER, "sean", "", "0")
+	authTap.Secret = "password"
+	outbox <- authTap
+	assert.Equal((<-inbox).Type, TYPE_TOKEN)
+	assert.Equal((<-inbox).Type, TYPE_AUTH)
+	outbox <- NewConversationTap("sean", "quinces")
+	quinces := <-inbox
+	assert.Equal(quinces.Type, TYPE_CONVERSATION)
+
+	// sean is told, then disconnected
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.True(server.Shutdown(ctx) == nil, "")
+	select {
+	case <-listener.closed:
+	default:
+		t.Fatal("Shutdown returned before sean's connection was written out and closed")
+	}
+	assert.Equal((<-inbox).Type, TYPE_SHUTDOWN)
+	_, ok := <-inbox
+	assert.False(ok, "")
+	close(outbox)
+
+	// nobody else gets in
+	_, err = net.Dial("tcp", listener.Addr().String())
+	assert.True(err != nil, "")
+	assert.True(server.Shutdown(ctx) != nil, "")
+
+	// and everything was saved
+	ids, err := snapshotIds(dir)
+	assert.True(err == nil && len(ids) == 1, "")
+	store := openFileStore(t, dir)
+	defer store.Close()
+	assert.Equal(store.Len(), 2)
+	assert.NotNil(store.Conversation(quinces.Conversation))
+}
+
+// closeListener tells when the server has closed the one connection it
+// accepts, which is slow to write to.
+type closeListener struct {
+	net.Listener
+	closed chan bool
+}
+
+func (l *closeListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &closeConn{Conn: conn, closed: l.closed}, nil
+}
+
+type closeConn struct {
+	net.Conn
+	closed chan bool
+	once   sync.Once
+}
+
+func (c *closeConn) Write(b []byte) (int, error) {
+	time.Sleep(10 * time.Millisecond)
+	return c.Conn.Write(b)
+}
+
+func (c *closeConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func TestConversationIdMigration(t *testing.T) {
+	assert := assert.Assert(t)
+	dir := t.TempDir()
+
+	// Data from before conversation ids: a snapshot and the log beyond it
+	legacy := []string{
+		`{"id":0,"type":"auth","user":"sean","conversation":"","value":"0","args":null}`,
+		`{"id":1,"type":"conversation","user":"sean","conversation":"olives","value":"Created conversation","args":null}`,
+		`{"id":2,"type":"message","user":"sean","conversation":"olives","value":"green","args":null}`,
+		`{"id":3,"type":"invite","user":"sean","conversation":"olives","value":"","args":["alex"]}`,
+	}
+	data := NewData()
+	for _, line := range legacy[:3] {
+		tap := new(Tap)
+		assert.True(json.Unmarshal([]byte(line), tap) == nil, "")
+		data.Taps = append(data.Taps, tap)
+	}
+	assert.True(WriteSnapshot(dir, 2, data) == nil, "")
+	err := ioutil.WriteFile(filepath.Join(dir, "taps.log"), []byte(strings.Join(legacy, "\n")+"\n"), 0644)
+	assert.True(err == nil, "")
+
+	check := func(store *FileStore) {
+		assert.Equal(store.Len(), 4)
+		olives := store.Conversation("1")
+		assert.NotNil(olives)
+		assert.Equal(olives.Title, "olives")
+		assert.Equal(len(olives.Messages), 3)
+		assert.Equal(olives.Messages[1].Body, "green")
+		assert.True(olives.HasUser("alex"), "")
+		assert.Equal(len(store.ConversationTaps("1", 4)), 3)
+	}
+	store := openFileStore(t, dir)
+	check(store)
+	assert.True(store.Close() == nil, "")
+
+	// The log was rewritten and the old snapshots dropped
+	ids, err := snapshotIds(dir)
+	assert.True(err == nil && len(ids) == 0, "")
+	log, err := OpenTapLog(filepath.Join(dir, "taps.log"), SYNC_NEVER, 0)
+	assert.True(err == nil, "")
+	log.Replay(func(tap *Tap) error {
+		assert.False(isLegacyTap(tap), "")
+		if tap.Id > 0 {
+			assert.Equal(tap.Conversation, "1")
+		}
+		return nil
+	})
+	log.Close()
+
+	// so opening it again changes nothing
+	store = openFileStore(t, dir)
+	check(store)
+	assert.True(store.Close() == nil, "")
 }